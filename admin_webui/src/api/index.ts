@@ -7,6 +7,9 @@ const apiClient = axios.create({
   baseURL: '/api',
   timeout: 5000,
   withCredentials: true,
+  // 服务器在 masque_admin_csrf Cookie 中下发 CSRF 令牌，修改类请求需要放入该请求头
+  xsrfCookieName: 'masque_admin_csrf',
+  xsrfHeaderName: 'X-CSRF-Token',
 })
 
 // Keep the original response data structure for non-error cases
@@ -40,6 +40,18 @@ const routes: Array<RouteRecordRaw> = [
     component: () => import(/* webpackChunkName: "settings" */ '@/views/SettingsView.vue'),
     meta: { requiresAuth: true },
   },
+  {
+    path: '/account/password',
+    name: 'ChangePassword',
+    component: () => import(/* webpackChunkName: "change-password" */ '@/views/ChangePasswordView.vue'),
+    meta: { requiresAuth: true },
+  },
+  {
+    path: '/account/2fa',
+    name: 'TwoFactor',
+    component: () => import(/* webpackChunkName: "two-factor" */ '@/views/TwoFactorView.vue'),
+    meta: { requiresAuth: true },
+  },
   {
     path: '/about',
     name: 'About',
@@ -62,6 +74,9 @@ router.beforeEach((to, _from, next) => {
     next({ name: 'Login', query: { redirect: to.fullPath } })
   } else if (to.meta.requiresGuest && isAuthenticated) {
     next({ name: 'Home' })
+  } else if (isAuthenticated && userStore.mustChangePassword && to.name !== 'ChangePassword') {
+    // 默认密码或被重置的密码必须先修改
+    next({ name: 'ChangePassword' })
   } else {
     next()
   }
@@ -3,12 +3,16 @@ import apiClient from '@/api' // 确保 apiClient 已正确配置
 
 interface UserState {
   username: string | null
+  role: string | null // viewer / operator / superadmin
+  mustChangePassword: boolean // 默认密码或管理员重置的密码，修改前不能访问其他接口
   isAuthenticated: boolean // 显式维护认证状态
 }
 
 export const useUserStore = defineStore('user', {
   state: (): UserState => ({
     username: null,
+    role: null,
+    mustChangePassword: false,
     isAuthenticated: false, // 初始化为 false
   }),
   getters: {
@@ -20,8 +24,10 @@ export const useUserStore = defineStore('user', {
     }
   },
   actions: {
-    loginSuccess(username: string) {
+    loginSuccess(username: string, role: string | null = null, mustChangePassword = false) {
       this.username = username
+      this.role = role
+      this.mustChangePassword = mustChangePassword
       this.isAuthenticated = true
       // HttpOnly cookie 由服务器设置
     },
@@ -36,11 +42,17 @@ export const useUserStore = defineStore('user', {
         // 即使API调用失败，也清理客户端状态
       }
       this.username = null
+      this.role = null
+      this.mustChangePassword = false
       this.isAuthenticated = false
       // HttpOnly cookie 的移除由服务器通过 SetCookie MaxAge=-1 处理
       // router.push('/login'); // 导航应由组件或路由守卫处理
     },
 
+    passwordChanged() {
+      this.mustChangePassword = false
+    },
+
     async checkAuthStatus() {
       try {
         // apiClient.get 直接返回数据对象 { loggedIn: boolean; username?: string }
@@ -51,10 +63,13 @@ export const useUserStore = defineStore('user', {
         if (response && response.loggedIn) {
           this.isAuthenticated = true;
           this.username = response.username || null;
+          this.role = response.role || null;
+          this.mustChangePassword = !!response.must_change_password;
           console.log('[UserStore] checkAuthStatus: isAuthenticated successfully SET to true. Current value:', this.isAuthenticated, 'Username:', this.username);
         } else {
           this.isAuthenticated = false;
           this.username = null;
+          this.role = null;
           console.log('[UserStore] checkAuthStatus: Conditions not met (loggedIn is false or response structure issue). Response was:', response, '. isAuthenticated SET to false.');
         }
       } catch (error: any) {
@@ -1,8 +1,9 @@
 package common
 
+import "fmt"
+
 // ClientConfig 结构体，用于存储从 TOML 文件加载的客户端配置信息
 // 可供 vpn_client/main.go 使用
-//
 type ClientConfig struct {
 	ServerAddr         string `toml:"server_addr"`
 	ServerName         string `toml:"server_name"`
@@ -17,6 +18,15 @@ type ClientConfig struct {
 	KeyLogFile         string `toml:"key_log_file"`
 	LogLevel           string `toml:"log_level"`
 	MTU                int    `toml:"mtu"`
+
+	// 首次注册：证书为空时凭一次性令牌向 enroll_url 提交 CSR，私钥在本机生成
+	EnrollURL   string `toml:"enroll_url"`
+	EnrollToken string `toml:"enroll_token"`
+	// 本机生成私钥使用的算法（如 ecdsa-p256、ed25519、rsa2048），为空时注册使用默认算法、续期沿用当前算法
+	KeyType string `toml:"key_type"`
+
+	// 证书剩余有效期少于该天数时，客户端通过隧道向服务器申请新证书并改写配置，0 表示默认 30 天，负数表示不自动续期
+	CertRenewBeforeDays int `toml:"cert_renew_before_days"`
 }
 
 // APIServerConfig 结构体，用于存储 API 服务器的配置信息
@@ -24,11 +34,26 @@ type APIServerConfig struct {
 	ListenAddr   string `toml:"listen_addr"`
 	StaticDir    string `toml:"static_dir"`
 	DatabasePath string `toml:"database_path"`
+
+	// 管理员会话的空闲超时（分钟）和最长有效期（小时），0 表示默认 30 分钟和 12 小时
+	SessionIdleTimeoutMinutes int `toml:"session_idle_timeout_minutes"`
+	SessionMaxLifetimeHours   int `toml:"session_max_lifetime_hours"`
+	// 强制为会话 Cookie 设置 Secure；通过 HTTPS 或声明 X-Forwarded-Proto: https 的可信反向代理访问时会自动设置
+	CookieSecure bool `toml:"cookie_secure"`
+	// 可信反向代理的地址或网段，只有来自这些地址的 X-Forwarded-For / X-Real-IP 才会被用作客户端 IP
+	// 为空时忽略这些请求头，直接使用连接的对端地址
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// 登录保护：同一用户名在同一 IP 上失败 login_max_failures 次、同一 IP 失败 login_max_failures_per_ip 次后锁定 login_lockout_minutes 分钟
+	// 0 表示默认 5 次、20 次和 15 分钟；每次失败后需要等待的时间从 1 秒开始翻倍，最长 30 秒，
+	// 用户名在所有来源上的失败只增加等待时间，不会锁定
+	LoginMaxFailures      int `toml:"login_max_failures"`
+	LoginMaxFailuresPerIP int `toml:"login_max_failures_per_ip"`
+	LoginLockoutMinutes   int `toml:"login_lockout_minutes"`
 }
 
 // ServerConfig 结构体，用于存储从 TOML 文件加载的服务端配置信息
 // 可供 vpn_server/main.go 使用
-//
 type ServerConfig struct {
 	ListenAddr      string   `toml:"listen_addr"`
 	CertFile        string   `toml:"cert_file"`
@@ -39,13 +64,68 @@ type ServerConfig struct {
 	KeyPEM          string   `toml:"key_pem"`
 	CAKeyPEM        string   `toml:"ca_key_pem"`
 	CACertPEM       string   `toml:"ca_cert_pem"`
-	AssignCIDR      string   `toml:"assign_cidr"`
+	AssignCIDR      CIDRList `toml:"assign_cidr"`
 	AdvertiseRoutes []string `toml:"advertise_routes"`
 	TunName         string   `toml:"tun_name"`
 	LogLevel        string   `toml:"log_level"`
 	ServerName      string   `toml:"server_name"`
 	MTU             int      `toml:"mtu"`
 
+	// TUN->VPN 分发器：读取 worker 数量和每个客户端的发送队列长度，0 表示使用默认值
+	DispatchWorkers int `toml:"dispatch_workers"`
+	ClientQueueSize int `toml:"client_queue_size"`
+
+	// 客户端隔离：开启后丢弃客户端之间的流量；关闭时客户端之间的流量在服务器进程内直接转发
+	ClientIsolation bool `toml:"client_isolation"`
+
+	// 出口 NAT：设置后服务器启动时为 assign_cidr 安装 nftables 伪装和转发规则，退出时清理（仅 Linux）
+	NATEgressInterface string `toml:"nat_egress_interface"`
+
+	// 新签发客户端证书的有效期（天），0 表示默认 3 年
+	ClientCertValidityDays int `toml:"client_cert_validity_days"`
+
+	// 使用中间 CA 签发时，ca_cert_file 为中间 CA，证书链（其上的中间 CA 和根 CA）放在这里，根 CA 私钥可以离线保存
+	CAChainFile string `toml:"ca_chain_file"`
+	CAChainPEM  string `toml:"ca_chain_pem"`
+	// CA 轮换期间额外信任的客户端 CA 证书
+	ClientCAFiles []string `toml:"client_ca_files"`
+
+	// 一次性注册令牌的有效期（小时），0 表示默认 24 小时
+	EnrollmentTokenTTLHours int `toml:"enrollment_token_ttl_hours"`
+
+	// IPAM：排除的地址永不分配，保留的地址只能通过管理接口固定给客户端
+	// 支持 "起始-结束"、CIDR 和单个地址三种写法，每一项必须属于某个 assign_cidr 网段
+	IPAMExclude  []string `toml:"ipam_exclude"`
+	IPAMReserved []string `toml:"ipam_reserved"`
+
+	// 下发给客户端的 DNS 配置，映射 [dns] 表
+	DNS DNSConfig `toml:"dns"`
+
 	// 修改：使用嵌套结构体来映射 [api_server] 表
 	APIServer APIServerConfig `toml:"api_server"`
 }
+
+// CIDRList 是 CIDR 字符串列表，TOML 中既可以写成单个字符串也可以写成数组
+// 例如 assign_cidr = "10.99.0.0/24" 或 assign_cidr = ["10.99.0.0/24", "fd00:99::/120"]
+type CIDRList []string
+
+// UnmarshalTOML 实现 toml.Unmarshaler，兼容旧的单字符串写法
+func (l *CIDRList) UnmarshalTOML(v interface{}) error {
+	switch val := v.(type) {
+	case string:
+		*l = CIDRList{val}
+	case []interface{}:
+		list := make(CIDRList, 0, len(val))
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("CIDR must be a string, got %T", item)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("CIDR list must be a string or an array of strings, got %T", v)
+	}
+	return nil
+}
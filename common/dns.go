@@ -0,0 +1,39 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// DNSConfig 是服务器下发给客户端的 DNS 配置
+type DNSConfig struct {
+	Servers       []string `toml:"servers" json:"servers"`               // VPN 内的 DNS 服务器
+	SearchDomains []string `toml:"search_domains" json:"search_domains"` // 搜索域，这些域名的查询发往 VPN DNS
+	RouteAll      bool     `toml:"route_all" json:"route_all"`           // 所有查询都发往 VPN DNS，否则只转发搜索域内的查询（split DNS）
+}
+
+// IsEmpty 判断是否未配置 DNS 服务器
+func (c DNSConfig) IsEmpty() bool {
+	return len(c.Servers) == 0
+}
+
+// ServerAddrs 解析 DNS 服务器地址
+func (c DNSConfig) ServerAddrs() ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(c.Servers))
+	for _, s := range c.Servers {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server %s: %v", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Equal 判断两份 DNS 配置是否相同
+func (c DNSConfig) Equal(other DNSConfig) bool {
+	return slices.Equal(c.Servers, other.Servers) &&
+		slices.Equal(c.SearchDomains, other.SearchDomains) &&
+		c.RouteAll == other.RouteAll
+}
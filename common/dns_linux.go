@@ -0,0 +1,134 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	resolvConfPath       = "/etc/resolv.conf"
+	resolvConfBackupPath = "/etc/resolv.conf.masque-vpn" // 改写前的原文件（或符号链接）
+	resolvedSocketPath   = "/run/systemd/resolve/io.systemd.Resolve"
+)
+
+// DNS 配置方式
+const (
+	dnsModeResolved   = "systemd-resolved"
+	dnsModeResolvConf = "resolv.conf"
+)
+
+// SetDNS 为TUN设备配置DNS
+// systemd-resolved 运行时按接口配置，支持 split DNS；否则改写 /etc/resolv.conf，原文件先备份，由 RevertDNS 恢复
+func (t *TUNDevice) SetDNS(cfg DNSConfig) error {
+	servers, err := cfg.ServerAddrs()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return t.RevertDNS()
+	}
+
+	if resolvedRunning() {
+		args := []string{"dns", t.name}
+		for _, s := range servers {
+			args = append(args, s.String())
+		}
+		if err := runResolvectl(args...); err != nil {
+			return err
+		}
+		// 搜索域同时是路由域；~. 表示所有查询都经由该接口
+		domains := append([]string{"domain", t.name}, cfg.SearchDomains...)
+		if cfg.RouteAll {
+			domains = append(domains, "~.")
+		}
+		if len(domains) == 2 {
+			domains = append(domains, "")
+		}
+		if err := runResolvectl(domains...); err != nil {
+			return err
+		}
+		if err := runResolvectl("default-route", t.name, fmt.Sprint(cfg.RouteAll)); err != nil {
+			return err
+		}
+		t.dnsMode = dnsModeResolved
+		log.Printf("Configured DNS %v (search %v, route all %v) on %s via systemd-resolved", servers, cfg.SearchDomains, cfg.RouteAll, t.name)
+		return nil
+	}
+
+	if !cfg.RouteAll {
+		log.Printf("Warning: systemd-resolved is not running, split DNS is not available and all queries will use %v", servers)
+	}
+	// 已存在备份说明上一次写入的仍是本程序生成的文件，不能覆盖原始备份
+	if _, err := os.Lstat(resolvConfBackupPath); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(resolvConfPath, resolvConfBackupPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to back up %s: %v", resolvConfPath, err)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by masque-vpn, original saved to %s\n", resolvConfBackupPath)
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(cfg.SearchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(cfg.SearchDomains, " "))
+	}
+	if err := os.WriteFile(resolvConfPath, []byte(b.String()), 0644); err != nil {
+		RecoverDNS()
+		return fmt.Errorf("failed to write %s: %v", resolvConfPath, err)
+	}
+	t.dnsMode = dnsModeResolvConf
+	log.Printf("Configured DNS %v (search %v) in %s", servers, cfg.SearchDomains, resolvConfPath)
+	return nil
+}
+
+// RevertDNS 撤销 SetDNS 的配置
+func (t *TUNDevice) RevertDNS() error {
+	mode := t.dnsMode
+	t.dnsMode = ""
+	switch mode {
+	case dnsModeResolved:
+		if err := runResolvectl("revert", t.name); err != nil {
+			return err
+		}
+		log.Printf("Reverted DNS configuration on %s", t.name)
+	case dnsModeResolvConf:
+		RecoverDNS()
+	}
+	return nil
+}
+
+// RecoverDNS 恢复被改写的 /etc/resolv.conf
+// 客户端启动时调用，用于恢复上次异常退出时遗留的配置
+func RecoverDNS() {
+	if _, err := os.Lstat(resolvConfBackupPath); err != nil {
+		return
+	}
+	if err := os.Rename(resolvConfBackupPath, resolvConfPath); err != nil {
+		log.Printf("Warning: failed to restore %s from %s: %v", resolvConfPath, resolvConfBackupPath, err)
+		return
+	}
+	log.Printf("Restored %s", resolvConfPath)
+}
+
+// resolvedRunning 判断 systemd-resolved 是否可用
+func resolvedRunning() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	_, err := os.Stat(resolvedSocketPath)
+	return err == nil
+}
+
+func runResolvectl(args ...string) error {
+	if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvectl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build windows
+// +build windows
+
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// SetDNS 为TUN设备配置DNS
+// Windows 上 DNS 按接口配置，随设备删除；不支持 split DNS，配置的服务器对所有查询生效
+func (t *TUNDevice) SetDNS(cfg DNSConfig) error {
+	servers, err := cfg.ServerAddrs()
+	if err != nil {
+		return err
+	}
+	var v4, v6 []netip.Addr
+	for _, s := range servers {
+		if s.Is4() {
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
+	}
+	if err := t.luid.SetDNS(winipcfg.AddressFamily(windows.AF_INET), v4, cfg.SearchDomains); err != nil {
+		return fmt.Errorf("failed to set DNS: %v", err)
+	}
+	if err := t.luid.SetDNS(winipcfg.AddressFamily(windows.AF_INET6), v6, cfg.SearchDomains); err != nil {
+		return fmt.Errorf("failed to set DNS: %v", err)
+	}
+	if !cfg.RouteAll && len(servers) > 0 {
+		log.Printf("Warning: split DNS is not supported on Windows, %v will be used for all queries", servers)
+	}
+	log.Printf("Configured DNS %v (search %v) on %s", servers, cfg.SearchDomains, t.name)
+	return nil
+}
+
+// RevertDNS 撤销 SetDNS 的配置
+func (t *TUNDevice) RevertDNS() error {
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		if err := t.luid.FlushDNS(family); err != nil {
+			return fmt.Errorf("failed to revert DNS: %v", err)
+		}
+	}
+	log.Printf("Reverted DNS configuration on %s", t.name)
+	return nil
+}
+
+// RecoverDNS 在 Windows 上无需处理，DNS 配置随接口一起删除
+func RecoverDNS() {}
@@ -0,0 +1,649 @@
+package common
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ------------------ IP 地址池（IPAM）实现 ------------------
+
+// IPAllocator 是单个网段地址池的接口
+// 服务器只通过该接口分配地址，可以替换为不同的实现
+type IPAllocator interface {
+	// Prefix 返回地址池所属的网段
+	Prefix() netip.Prefix
+	// Allocate 为客户端分配一个主机地址（IPv4 为 /32，IPv6 为 /128）
+	// taken 表示本次调用新占用了该地址，客户端已经持有该地址（例如旧连接尚未释放）时为 false
+	Allocate(clientID string) (prefix netip.Prefix, taken bool, err error)
+	// Release 归还地址
+	Release(ip netip.Addr)
+	// Remember 记录客户端上次使用的地址，用于粘性分配
+	Remember(clientID string, ip netip.Addr)
+	// SetStatic 为客户端固定一个地址，传入无效地址表示取消固定
+	SetStatic(clientID string, ip netip.Addr) error
+	// CheckStatic 检查 SetStatic 能否成功，不做任何修改
+	CheckStatic(clientID string, ip netip.Addr) error
+	// Forget 清除客户端的粘性和固定地址记录
+	Forget(clientID string)
+	// Stats 返回地址池的使用情况
+	Stats() PoolStats
+}
+
+// PoolStats 是地址池的使用情况统计
+type PoolStats struct {
+	Prefix      string  `json:"prefix"`
+	Capacity    uint64  `json:"capacity"`    // 可分配地址总数（不含排除的地址）
+	Reserved    uint64  `json:"reserved"`    // 保留范围内、只能固定分配的地址数
+	Static      int     `json:"static"`      // 已固定给客户端的地址数
+	Allocated   int     `json:"allocated"`   // 当前已分配的地址数
+	Utilization float64 `json:"utilization"` // Allocated / Capacity
+}
+
+// IPRange 表示闭区间 [From, To] 内的地址
+type IPRange struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+// ParseIPRange 解析地址范围，支持 "起始-结束"、CIDR 和单个地址三种写法
+func ParseIPRange(s string) (IPRange, error) {
+	s = strings.TrimSpace(s)
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		fromAddr, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return IPRange{}, fmt.Errorf("invalid IP range %s: %v", s, err)
+		}
+		toAddr, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return IPRange{}, fmt.Errorf("invalid IP range %s: %v", s, err)
+		}
+		if fromAddr.Is4() != toAddr.Is4() || toAddr.Less(fromAddr) {
+			return IPRange{}, fmt.Errorf("invalid IP range %s", s)
+		}
+		return IPRange{From: fromAddr, To: toAddr}, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return IPRange{}, fmt.Errorf("invalid IP range %s: %v", s, err)
+		}
+		prefix = prefix.Masked()
+		return IPRange{From: prefix.Addr(), To: LastIP(prefix)}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return IPRange{}, fmt.Errorf("invalid IP range %s: %v", s, err)
+	}
+	return IPRange{From: addr, To: addr}, nil
+}
+
+func (r IPRange) String() string {
+	if r.From == r.To {
+		return r.From.String()
+	}
+	return r.From.String() + "-" + r.To.String()
+}
+
+// IPPoolOptions 是创建地址池时的可选参数
+type IPPoolOptions struct {
+	Exclude  []IPRange // 永不分配的地址
+	Reserved []IPRange // 不参与动态分配，只能通过 SetStatic 固定给客户端的地址
+}
+
+// offsetRange 是以网段起始地址偏移量表示的闭区间
+type offsetRange struct {
+	lo, hi uint64
+}
+
+// offsetHeap 是偏移量的最小堆，用于优先复用最小的已释放地址
+type offsetHeap []uint64
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// IPPool 是 IPAllocator 的默认实现，线程安全
+// 地址用相对网段起始地址的偏移量表示，不预先生成地址列表：
+//   - cursor 及之后的地址从未被分配过，动态分配时顺序推进 cursor；
+//   - cursor 之前被释放的地址放入最小堆，优先复用；
+//   - 排除范围和保留范围以有序区间保存，通过二分查找跳过。
+//
+// 分配和释放均为 O(log n)，内存只与已分配、已释放的地址数量有关。
+// 支持粘性分配（记住每个客户端上次使用的地址）和管理员固定地址。
+// IPv6 网段的主机位最多 64 位（即 /64 或更长的前缀）。
+type IPPool struct {
+	prefix     netip.Prefix
+	gateway    netip.Addr
+	last       uint64 // 网段内最大的偏移量
+	cursor     uint64 // 下一个从未分配过的偏移量
+	cursorDone bool   // cursor 已越过 last
+	freed      offsetHeap
+	freedSet   map[uint64]struct{}
+	exclude    []offsetRange         // 永不分配：网络地址、网关、IPv4 广播地址及配置的排除范围
+	reserved   []offsetRange         // 只允许固定分配的范围（已去除排除部分）
+	allocated  map[uint64]string     // 偏移量 -> clientID
+	lastIP     map[string]netip.Addr // clientID -> 上次分配的 IP
+	staticIP   map[string]netip.Addr // clientID -> 管理员固定的 IP
+	reservedBy map[uint64]string     // 固定 IP 的偏移量 -> clientID
+	mu         sync.Mutex
+}
+
+// NewIPPool 创建 IP 地址池，自动跳过网络地址、网关和 IPv4 广播地址
+func NewIPPool(prefix netip.Prefix, gateway netip.Addr, opts IPPoolOptions) (*IPPool, error) {
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 64 {
+		return nil, fmt.Errorf("prefix %s is too large, IPv6 pools must be /64 or longer", prefix)
+	}
+	last := uint64(math.MaxUint64)
+	if hostBits < 64 {
+		last = 1<<hostBits - 1
+	}
+
+	p := &IPPool{
+		prefix:     prefix,
+		gateway:    gateway,
+		last:       last,
+		freedSet:   make(map[uint64]struct{}),
+		allocated:  make(map[uint64]string),
+		lastIP:     make(map[string]netip.Addr),
+		staticIP:   make(map[string]netip.Addr),
+		reservedBy: make(map[uint64]string),
+	}
+
+	exclude := []offsetRange{{0, 0}}
+	if prefix.Contains(gateway) {
+		off := p.offset(gateway)
+		exclude = append(exclude, offsetRange{off, off})
+	}
+	if prefix.Addr().Is4() && hostBits >= 2 {
+		exclude = append(exclude, offsetRange{last, last})
+	}
+	for _, r := range opts.Exclude {
+		or, err := p.toOffsetRange(r)
+		if err != nil {
+			return nil, err
+		}
+		exclude = append(exclude, or)
+	}
+	p.exclude = normalizeRanges(exclude)
+
+	var reserved []offsetRange
+	for _, r := range opts.Reserved {
+		or, err := p.toOffsetRange(r)
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, or)
+	}
+	p.reserved = subtractRanges(normalizeRanges(reserved), p.exclude)
+
+	return p, nil
+}
+
+// Prefix 返回地址池所属的网段
+func (p *IPPool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Allocate 为客户端分配 IP，返回主机前缀（IPv4 为 /32，IPv6 为 /128）
+// 优先级：管理员固定的地址 > 该客户端上次使用的地址 > 最小的可用地址。
+// 如果目标地址仍被同一客户端的旧连接占用（例如断线重连），直接复用该地址。
+func (p *IPPool) Allocate(clientID string) (netip.Prefix, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip, ok := p.staticIP[clientID]; ok {
+		off := p.offset(ip)
+		owner, used := p.allocated[off]
+		if used && owner != clientID {
+			return netip.Prefix{}, false, fmt.Errorf("static IP %s of client %s is in use by %s", ip, clientID, owner)
+		}
+		p.take(off, clientID)
+		return netip.PrefixFrom(ip, ip.BitLen()), !used, nil
+	}
+
+	if ip, ok := p.lastIP[clientID]; ok && p.usableBy(p.offset(ip), clientID) {
+		_, used := p.allocated[p.offset(ip)]
+		p.take(p.offset(ip), clientID)
+		return netip.PrefixFrom(ip, ip.BitLen()), !used, nil
+	}
+
+	off, ok := p.nextFree(clientID)
+	if !ok {
+		return netip.Prefix{}, false, fmt.Errorf("no available IP addresses")
+	}
+	p.take(off, clientID)
+	ip := p.addr(off)
+	return netip.PrefixFrom(ip, ip.BitLen()), true, nil
+}
+
+// Release 释放 IP 地址
+func (p *IPPool) Release(ip netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.prefix.Contains(ip) {
+		return
+	}
+	off := p.offset(ip)
+	if _, ok := p.allocated[off]; ok {
+		delete(p.allocated, off)
+		p.recycle(off)
+	}
+}
+
+// Remember 记录客户端上次使用的地址，用于从持久化存储恢复粘性分配
+func (p *IPPool) Remember(clientID string, ip netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inRange(ip) {
+		p.lastIP[clientID] = ip
+	}
+}
+
+// SetStatic 为客户端固定一个地址，传入无效地址表示取消固定
+// 固定地址不会再分配给其他客户端，可以位于保留范围内
+func (p *IPPool) SetStatic(clientID string, ip netip.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !ip.IsValid() {
+		p.clearStatic(clientID)
+		return nil
+	}
+	if err := p.checkStatic(clientID, ip); err != nil {
+		return err
+	}
+	off := p.offset(ip)
+	if old, ok := p.staticIP[clientID]; ok && old != ip {
+		p.clearStatic(clientID)
+	}
+	p.staticIP[clientID] = ip
+	p.reservedBy[off] = clientID
+	return nil
+}
+
+// CheckStatic 检查能否为客户端固定该地址，不做任何修改
+func (p *IPPool) CheckStatic(clientID string, ip netip.Addr) error {
+	if !ip.IsValid() {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.checkStatic(clientID, ip)
+}
+
+// checkStatic 检查固定地址是否可用，调用方需持有 p.mu
+func (p *IPPool) checkStatic(clientID string, ip netip.Addr) error {
+	if !p.inRange(ip) {
+		return fmt.Errorf("IP %s is not assignable in %s", ip, p.prefix)
+	}
+	off := p.offset(ip)
+	if owner, ok := p.reservedBy[off]; ok && owner != clientID {
+		return fmt.Errorf("IP %s is already reserved for client %s", ip, owner)
+	}
+	if owner, ok := p.allocated[off]; ok && owner != clientID {
+		return fmt.Errorf("IP %s is currently in use by client %s", ip, owner)
+	}
+	return nil
+}
+
+// Forget 清除客户端的粘性和固定地址记录（客户端被删除时调用）
+func (p *IPPool) Forget(clientID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearStatic(clientID)
+	delete(p.lastIP, clientID)
+}
+
+// Stats 返回地址池的使用情况
+func (p *IPPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 排除范围总是包含网络地址，因此 excluded >= 1，不会溢出
+	capacity := p.last - (rangeSum(p.exclude) - 1)
+	stats := PoolStats{
+		Prefix:    p.prefix.String(),
+		Capacity:  capacity,
+		Reserved:  rangeSum(p.reserved),
+		Static:    len(p.staticIP),
+		Allocated: len(p.allocated),
+	}
+	if capacity > 0 {
+		stats.Utilization = float64(stats.Allocated) / float64(capacity)
+	}
+	return stats
+}
+
+// clearStatic 取消客户端的固定地址，空闲的地址重新参与动态分配
+func (p *IPPool) clearStatic(clientID string) {
+	ip, ok := p.staticIP[clientID]
+	if !ok {
+		return
+	}
+	off := p.offset(ip)
+	delete(p.reservedBy, off)
+	delete(p.staticIP, clientID)
+	if _, used := p.allocated[off]; !used {
+		p.recycle(off)
+	}
+}
+
+// nextFree 返回下一个可动态分配的偏移量：先复用已释放的最小地址，再推进 cursor
+func (p *IPPool) nextFree(clientID string) (uint64, bool) {
+	for p.freed.Len() > 0 {
+		off := heap.Pop(&p.freed).(uint64)
+		delete(p.freedSet, off)
+		if p.dynamicUsable(off, clientID) {
+			return off, true
+		}
+	}
+	for !p.cursorDone {
+		off := p.cursor
+		if r, ok := findRange(p.exclude, off); ok {
+			p.advance(r.hi)
+			continue
+		}
+		if r, ok := findRange(p.reserved, off); ok {
+			p.advance(r.hi)
+			continue
+		}
+		p.advance(off)
+		if p.dynamicUsable(off, clientID) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// advance 将 cursor 移动到 off 之后
+func (p *IPPool) advance(off uint64) {
+	if off >= p.last {
+		p.cursorDone = true
+		return
+	}
+	p.cursor = off + 1
+}
+
+// recycle 将空闲地址放回最小堆；cursor 尚未到达的地址无需处理
+func (p *IPPool) recycle(off uint64) {
+	if !p.cursorDone && off >= p.cursor {
+		return
+	}
+	if _, ok := findRange(p.reserved, off); ok {
+		return
+	}
+	if _, ok := p.reservedBy[off]; ok {
+		return
+	}
+	if _, ok := p.freedSet[off]; ok {
+		return
+	}
+	p.freedSet[off] = struct{}{}
+	heap.Push(&p.freed, off)
+}
+
+// dynamicUsable 判断地址能否动态分配给客户端：未被占用且未被其他客户端固定
+func (p *IPPool) dynamicUsable(off uint64, clientID string) bool {
+	if _, used := p.allocated[off]; used {
+		return false
+	}
+	owner, reserved := p.reservedBy[off]
+	return !reserved || owner == clientID
+}
+
+// usableBy 判断上次使用的地址能否再次分配给客户端：
+// 不在排除或保留范围内，未被其他客户端固定，且空闲或仍由该客户端持有
+func (p *IPPool) usableBy(off uint64, clientID string) bool {
+	if _, ok := findRange(p.exclude, off); ok {
+		return false
+	}
+	if _, ok := findRange(p.reserved, off); ok {
+		return false
+	}
+	if owner, reserved := p.reservedBy[off]; reserved && owner != clientID {
+		return false
+	}
+	owner, used := p.allocated[off]
+	return !used || owner == clientID
+}
+
+// inRange 判断地址是否属于网段且不在排除范围内
+func (p *IPPool) inRange(ip netip.Addr) bool {
+	if !p.prefix.Contains(ip) {
+		return false
+	}
+	_, excluded := findRange(p.exclude, p.offset(ip))
+	return !excluded
+}
+
+// take 将指定地址标记为已分配给客户端，堆中残留的记录在弹出时跳过
+func (p *IPPool) take(off uint64, clientID string) {
+	p.allocated[off] = clientID
+	p.lastIP[clientID] = p.addr(off)
+}
+
+// offset 返回地址相对网段起始地址的偏移量，调用方需保证地址属于网段
+func (p *IPPool) offset(ip netip.Addr) uint64 {
+	base := p.prefix.Addr()
+	if base.Is4() {
+		a, b := ip.As4(), base.As4()
+		return uint64(binary.BigEndian.Uint32(a[:]) - binary.BigEndian.Uint32(b[:]))
+	}
+	a, b := ip.As16(), base.As16()
+	return binary.BigEndian.Uint64(a[8:]) - binary.BigEndian.Uint64(b[8:])
+}
+
+// addr 返回偏移量对应的地址
+func (p *IPPool) addr(off uint64) netip.Addr {
+	base := p.prefix.Addr()
+	if base.Is4() {
+		b := base.As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(off))
+		return netip.AddrFrom4(b)
+	}
+	b := base.As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+off)
+	return netip.AddrFrom16(b)
+}
+
+// toOffsetRange 将地址范围转换为偏移量区间，范围必须完全位于网段内
+func (p *IPPool) toOffsetRange(r IPRange) (offsetRange, error) {
+	if !p.prefix.Contains(r.From) || !p.prefix.Contains(r.To) {
+		return offsetRange{}, fmt.Errorf("IP range %s is not within %s", r, p.prefix)
+	}
+	return offsetRange{p.offset(r.From), p.offset(r.To)}, nil
+}
+
+// normalizeRanges 排序并合并重叠或相邻的区间
+func normalizeRanges(rs []offsetRange) []offsetRange {
+	sort.Slice(rs, func(i, j int) bool { return rs[i].lo < rs[j].lo })
+	var out []offsetRange
+	for _, r := range rs {
+		if n := len(out); n > 0 && (r.lo <= out[n-1].hi || r.lo == out[n-1].hi+1) {
+			if r.hi > out[n-1].hi {
+				out[n-1].hi = r.hi
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// subtractRanges 返回 a 中不与 b 重叠的部分，a 和 b 都必须已规范化
+func subtractRanges(a, b []offsetRange) []offsetRange {
+	var out []offsetRange
+	for _, r := range a {
+		lo, covered := r.lo, false
+		for _, x := range b {
+			if x.hi < lo || x.lo > r.hi {
+				continue
+			}
+			if x.lo > lo {
+				out = append(out, offsetRange{lo, x.lo - 1})
+			}
+			if x.hi >= r.hi {
+				covered = true
+				break
+			}
+			lo = x.hi + 1
+		}
+		if !covered {
+			out = append(out, offsetRange{lo, r.hi})
+		}
+	}
+	return out
+}
+
+// findRange 在有序区间中二分查找包含 off 的区间
+func findRange(rs []offsetRange, off uint64) (offsetRange, bool) {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].hi >= off })
+	if i < len(rs) && rs[i].lo <= off {
+		return rs[i], true
+	}
+	return offsetRange{}, false
+}
+
+// rangeSum 返回区间内地址的总数
+func rangeSum(rs []offsetRange) uint64 {
+	var sum uint64
+	for _, r := range rs {
+		sum += r.hi - r.lo + 1
+	}
+	return sum
+}
+
+// ------------------ 双栈地址池 ------------------
+
+// IPPoolSet 按地址族组合多个地址池（每个地址族最多一个），为客户端同时分配 IPv4 和 IPv6 地址
+type IPPoolSet struct {
+	pools []IPAllocator
+}
+
+// NewIPPoolSet 组合多个地址池，同一地址族只允许出现一次
+func NewIPPoolSet(pools []IPAllocator) (*IPPoolSet, error) {
+	set := &IPPoolSet{}
+	for _, pool := range pools {
+		for _, p := range set.pools {
+			if p.Prefix().Addr().Is4() == pool.Prefix().Addr().Is4() {
+				return nil, fmt.Errorf("only one CIDR per address family is supported: %s conflicts with %s", pool.Prefix(), p.Prefix())
+			}
+		}
+		set.pools = append(set.pools, pool)
+	}
+	if len(set.pools) == 0 {
+		return nil, fmt.Errorf("no CIDR configured")
+	}
+	return set, nil
+}
+
+// Allocate 从每个地址族的地址池中各分配一个地址
+// 任意一个地址池分配失败时，回滚本次调用新占用的地址；客户端旧连接仍在使用的地址保持不变
+func (s *IPPoolSet) Allocate(clientID string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(s.pools))
+	var taken []netip.Addr
+	for _, p := range s.pools {
+		prefix, fresh, err := p.Allocate(clientID)
+		if err != nil {
+			for _, ip := range taken {
+				s.Release(ip)
+			}
+			return nil, fmt.Errorf("%s: %w", p.Prefix(), err)
+		}
+		prefixes = append(prefixes, prefix)
+		if fresh {
+			taken = append(taken, prefix.Addr())
+		}
+	}
+	return prefixes, nil
+}
+
+// Release 将地址归还给所属的地址池
+func (s *IPPoolSet) Release(ip netip.Addr) {
+	if p := s.poolFor(ip); p != nil {
+		p.Release(ip)
+	}
+}
+
+// Remember 记录客户端上次使用的地址，不属于任何地址池的地址会被忽略
+func (s *IPPoolSet) Remember(clientID string, ip netip.Addr) {
+	if p := s.poolFor(ip); p != nil {
+		p.Remember(clientID, ip)
+	}
+}
+
+// SetStatic 为客户端设置固定地址，每个地址族最多一个，未出现的地址族取消固定
+func (s *IPPoolSet) SetStatic(clientID string, ips []netip.Addr) error {
+	perPool := make(map[IPAllocator]netip.Addr, len(ips))
+	for _, ip := range ips {
+		p := s.poolFor(ip)
+		if p == nil {
+			return fmt.Errorf("IP %s does not belong to any address pool", ip)
+		}
+		if _, dup := perPool[p]; dup {
+			return fmt.Errorf("only one static IP per address family is allowed")
+		}
+		perPool[p] = ip
+	}
+	// 先检查所有地址池，避免只修改了部分地址族
+	for _, p := range s.pools {
+		if err := p.CheckStatic(clientID, perPool[p]); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.pools {
+		if err := p.SetStatic(clientID, perPool[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget 清除客户端在所有地址池中的记录
+func (s *IPPoolSet) Forget(clientID string) {
+	for _, p := range s.pools {
+		p.Forget(clientID)
+	}
+}
+
+// Stats 返回所有地址池的使用情况
+func (s *IPPoolSet) Stats() []PoolStats {
+	stats := make([]PoolStats, 0, len(s.pools))
+	for _, p := range s.pools {
+		stats = append(stats, p.Stats())
+	}
+	return stats
+}
+
+// Prefixes 返回所有地址池的网段
+func (s *IPPoolSet) Prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(s.pools))
+	for _, p := range s.pools {
+		prefixes = append(prefixes, p.Prefix())
+	}
+	return prefixes
+}
+
+// poolFor 返回包含该地址的地址池
+func (s *IPPoolSet) poolFor(ip netip.Addr) IPAllocator {
+	for _, p := range s.pools {
+		if p.Prefix().Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
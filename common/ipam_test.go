@@ -0,0 +1,333 @@
+package common
+
+import (
+	"math"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func mustPool(t *testing.T, cidr, gateway string, opts IPPoolOptions) *IPPool {
+	t.Helper()
+	p, err := NewIPPool(netip.MustParsePrefix(cidr), netip.MustParseAddr(gateway), opts)
+	if err != nil {
+		t.Fatalf("NewIPPool(%s): %v", cidr, err)
+	}
+	return p
+}
+
+func mustAllocate(t *testing.T, p IPAllocator, clientID string) netip.Addr {
+	t.Helper()
+	prefix, _, err := p.Allocate(clientID)
+	if err != nil {
+		t.Fatalf("Allocate(%s): %v", clientID, err)
+	}
+	return prefix.Addr()
+}
+
+func TestNormalizeRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []offsetRange
+		want []offsetRange
+	}{
+		{"empty", nil, nil},
+		{"single", []offsetRange{{3, 5}}, []offsetRange{{3, 5}}},
+		{"unsorted disjoint", []offsetRange{{10, 12}, {1, 2}}, []offsetRange{{1, 2}, {10, 12}}},
+		{"overlapping", []offsetRange{{1, 5}, {4, 8}}, []offsetRange{{1, 8}}},
+		{"adjacent", []offsetRange{{1, 5}, {6, 8}}, []offsetRange{{1, 8}}},
+		{"contained", []offsetRange{{1, 10}, {3, 4}}, []offsetRange{{1, 10}}},
+		{"up to max", []offsetRange{{0, 0}, {1, math.MaxUint64}, {5, 6}}, []offsetRange{{0, math.MaxUint64}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeRanges(slices.Clone(tt.in)); !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeRanges(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []offsetRange
+		want []offsetRange
+	}{
+		{"nothing to subtract", []offsetRange{{1, 5}}, nil, []offsetRange{{1, 5}}},
+		{"disjoint", []offsetRange{{1, 5}}, []offsetRange{{7, 9}}, []offsetRange{{1, 5}}},
+		{"hole in the middle", []offsetRange{{1, 10}}, []offsetRange{{4, 6}}, []offsetRange{{1, 3}, {7, 10}}},
+		{"cut both ends", []offsetRange{{1, 10}}, []offsetRange{{0, 2}, {9, 12}}, []offsetRange{{3, 8}}},
+		{"fully covered", []offsetRange{{3, 5}}, []offsetRange{{0, 10}}, nil},
+		{"several ranges", []offsetRange{{1, 3}, {6, 9}}, []offsetRange{{2, 2}, {9, 9}}, []offsetRange{{1, 1}, {3, 3}, {6, 8}}},
+		{"whole /64", []offsetRange{{0, math.MaxUint64}}, []offsetRange{{0, 1}}, []offsetRange{{2, math.MaxUint64}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subtractRanges(tt.a, tt.b); !slices.Equal(got, tt.want) {
+				t.Errorf("subtractRanges(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPPoolRecyclesSmallestFreedAddress(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/28", "10.0.0.1", IPPoolOptions{})
+	for _, id := range []string{"a", "b", "c", "d"} {
+		mustAllocate(t, p, id)
+	}
+	p.Release(netip.MustParseAddr("10.0.0.4"))
+	p.Release(netip.MustParseAddr("10.0.0.3"))
+
+	for _, want := range []string{"10.0.0.3", "10.0.0.4", "10.0.0.6"} {
+		if got := mustAllocate(t, p, "new-"+want); got != netip.MustParseAddr(want) {
+			t.Errorf("Allocate = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestIPPoolStickyAndStatic(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, p *IPPool)
+		want  string
+	}{
+		{
+			name: "sticky address is reused",
+			setup: func(t *testing.T, p *IPPool) {
+				p.Remember("a", netip.MustParseAddr("10.0.0.9"))
+			},
+			want: "10.0.0.9",
+		},
+		{
+			name: "static wins over sticky",
+			setup: func(t *testing.T, p *IPPool) {
+				p.Remember("a", netip.MustParseAddr("10.0.0.9"))
+				if err := p.SetStatic("a", netip.MustParseAddr("10.0.0.7")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "10.0.0.7",
+		},
+		{
+			name: "sticky address pinned to another client is skipped",
+			setup: func(t *testing.T, p *IPPool) {
+				p.Remember("a", netip.MustParseAddr("10.0.0.9"))
+				if err := p.SetStatic("b", netip.MustParseAddr("10.0.0.9")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "static address in a reserved range",
+			setup: func(t *testing.T, p *IPPool) {
+				if err := p.SetStatic("a", netip.MustParseAddr("10.0.0.12")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "10.0.0.12",
+		},
+		{
+			name: "cleared static falls back to sticky",
+			setup: func(t *testing.T, p *IPPool) {
+				if err := p.SetStatic("a", netip.MustParseAddr("10.0.0.7")); err != nil {
+					t.Fatal(err)
+				}
+				p.Remember("a", netip.MustParseAddr("10.0.0.9"))
+				if err := p.SetStatic("a", netip.Addr{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "10.0.0.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mustPool(t, "10.0.0.0/28", "10.0.0.1", IPPoolOptions{
+				Reserved: []IPRange{{From: netip.MustParseAddr("10.0.0.12"), To: netip.MustParseAddr("10.0.0.14")}},
+			})
+			tt.setup(t, p)
+			if got := mustAllocate(t, p, "a"); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("Allocate = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPPoolStaticConflicts(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/28", "10.0.0.1", IPPoolOptions{})
+	inUse := mustAllocate(t, p, "a")
+	if err := p.SetStatic("b", inUse); err == nil {
+		t.Errorf("SetStatic accepted %s in use by another client", inUse)
+	}
+	if err := p.SetStatic("b", netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Errorf("SetStatic accepted the gateway")
+	}
+	if err := p.SetStatic("b", netip.MustParseAddr("10.0.0.5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetStatic("c", netip.MustParseAddr("10.0.0.5")); err == nil {
+		t.Errorf("SetStatic accepted an address pinned to another client")
+	}
+	// 被固定的地址不会动态分配给其他客户端
+	for _, id := range []string{"x", "y", "z"} {
+		if got := mustAllocate(t, p, id); got == netip.MustParseAddr("10.0.0.5") {
+			t.Fatalf("dynamic allocation returned static address %s", got)
+		}
+	}
+}
+
+func TestIPPoolFull(t *testing.T) {
+	// /30：网络地址、网关和广播地址之外只剩一个地址
+	p := mustPool(t, "10.0.0.0/30", "10.0.0.1", IPPoolOptions{})
+	if got := mustAllocate(t, p, "a"); got != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("Allocate = %s, want 10.0.0.2", got)
+	}
+	if _, _, err := p.Allocate("b"); err == nil {
+		t.Fatal("Allocate succeeded on a full pool")
+	}
+	// 同一客户端重连时复用仍被旧连接持有的地址
+	prefix, taken, err := p.Allocate("a")
+	if err != nil || prefix.Addr() != netip.MustParseAddr("10.0.0.2") || taken {
+		t.Fatalf("Allocate(a) again = %s, %v, %v; want 10.0.0.2, false, nil", prefix, taken, err)
+	}
+	p.Release(netip.MustParseAddr("10.0.0.2"))
+	if got := mustAllocate(t, p, "b"); got != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("Allocate after release = %s, want 10.0.0.2", got)
+	}
+	if stats := p.Stats(); stats.Capacity != 1 || stats.Allocated != 1 {
+		t.Errorf("Stats = %+v, want capacity 1 and 1 allocated", stats)
+	}
+}
+
+func TestIPPoolIPv6(t *testing.T) {
+	p := mustPool(t, "fd00::/64", "fd00::1", IPPoolOptions{
+		Exclude: []IPRange{{From: netip.MustParseAddr("fd00::3"), To: netip.MustParseAddr("fd00::4")}},
+	})
+	var got []netip.Addr
+	for _, id := range []string{"a", "b", "c"} {
+		prefix, _, err := p.Allocate(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix.Bits() != 128 {
+			t.Errorf("Allocate returned %s, want a /128", prefix)
+		}
+		got = append(got, prefix.Addr())
+	}
+	want := []netip.Addr{netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::5"), netip.MustParseAddr("fd00::6")}
+	if !slices.Equal(got, want) {
+		t.Errorf("allocated %v, want %v", got, want)
+	}
+	// 网络地址、网关和两个排除的地址
+	if stats := p.Stats(); stats.Capacity != math.MaxUint64-3 {
+		t.Errorf("Capacity = %d, want %d", stats.Capacity, uint64(math.MaxUint64-3))
+	}
+
+	last := netip.MustParseAddr("fd00::ffff:ffff:ffff:ffff")
+	if err := p.SetStatic("d", last); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustAllocate(t, p, "d"); got != last {
+		t.Errorf("Allocate(d) = %s, want %s", got, last)
+	}
+
+	if _, err := NewIPPool(netip.MustParsePrefix("fd00::/56"), netip.MustParseAddr("fd00::1"), IPPoolOptions{}); err == nil {
+		t.Error("NewIPPool accepted an IPv6 prefix shorter than /64")
+	}
+}
+
+func TestIPPoolReservedWholeIPv6Prefix(t *testing.T) {
+	// 保留整个 /64，区间长度之和接近 2^64，统计时不能溢出
+	p := mustPool(t, "fd00::/64", "fd00::1", IPPoolOptions{
+		Reserved: []IPRange{{From: netip.MustParseAddr("fd00::"), To: netip.MustParseAddr("fd00::ffff:ffff:ffff:ffff")}},
+	})
+	stats := p.Stats()
+	if stats.Capacity != math.MaxUint64-1 || stats.Reserved != math.MaxUint64-1 {
+		t.Errorf("Stats = %+v, want capacity and reserved %d", stats, uint64(math.MaxUint64-1))
+	}
+	if _, _, err := p.Allocate("a"); err == nil {
+		t.Fatal("dynamic allocation succeeded although the whole prefix is reserved")
+	}
+	ip := netip.MustParseAddr("fd00::1234")
+	if err := p.SetStatic("a", ip); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustAllocate(t, p, "a"); got != ip {
+		t.Errorf("Allocate = %s, want %s", got, ip)
+	}
+}
+
+func TestIPPoolExcludeWholeIPv6Prefix(t *testing.T) {
+	p := mustPool(t, "fd00::/64", "fd00::1", IPPoolOptions{
+		Exclude: []IPRange{{From: netip.MustParseAddr("fd00::"), To: netip.MustParseAddr("fd00::ffff:ffff:ffff:ffff")}},
+	})
+	if stats := p.Stats(); stats.Capacity != 0 || stats.Utilization != 0 {
+		t.Errorf("Stats = %+v, want capacity 0", stats)
+	}
+	if _, _, err := p.Allocate("a"); err == nil {
+		t.Fatal("Allocate succeeded although the whole prefix is excluded")
+	}
+}
+
+func TestIPPoolSetAllocateRollback(t *testing.T) {
+	v6 := mustPool(t, "fd00::/64", "fd00::1", IPPoolOptions{})
+	v4 := mustPool(t, "10.0.0.0/30", "10.0.0.1", IPPoolOptions{})
+	set, err := NewIPPoolSet([]IPAllocator{v6, v4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := set.Allocate("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 地址池已满：b 新占用的 IPv6 地址需要回滚
+	if _, err := set.Allocate("b"); err == nil {
+		t.Fatal("Allocate(b) succeeded on a full IPv4 pool")
+	}
+	if n := v6.Stats().Allocated; n != 1 {
+		t.Errorf("IPv6 allocated = %d after rollback, want 1", n)
+	}
+
+	// a 的旧连接仍持有 IPv6 地址时重连失败，不能释放旧连接的地址
+	set.Release(a[1].Addr())
+	if _, err := set.Allocate("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Allocate("a"); err == nil {
+		t.Fatal("Allocate(a) succeeded although its IPv4 address was taken by c")
+	}
+	if owner := v6.allocated[v6.offset(a[0].Addr())]; owner != "a" {
+		t.Errorf("IPv6 address %s owned by %q after failed reconnect, want a", a[0].Addr(), owner)
+	}
+}
+
+func TestIPPoolSetSetStaticIsAtomic(t *testing.T) {
+	v4 := mustPool(t, "10.0.0.0/28", "10.0.0.1", IPPoolOptions{})
+	v6 := mustPool(t, "fd00::/64", "fd00::1", IPPoolOptions{})
+	set, err := NewIPPoolSet([]IPAllocator{v4, v6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := set.Allocate("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = set.SetStatic("a", []netip.Addr{netip.MustParseAddr("10.0.0.9"), b[1].Addr()})
+	if err == nil {
+		t.Fatal("SetStatic accepted an IPv6 address in use by another client")
+	}
+	if n := v4.Stats().Static; n != 0 {
+		t.Errorf("IPv4 static count = %d after failed SetStatic, want 0", n)
+	}
+
+	if err := set.SetStatic("a", []netip.Addr{netip.MustParseAddr("10.0.0.9"), netip.MustParseAddr("10.0.0.10")}); err == nil {
+		t.Error("SetStatic accepted two addresses of the same family")
+	}
+	if err := set.SetStatic("a", []netip.Addr{netip.MustParseAddr("192.168.0.1")}); err == nil {
+		t.Error("SetStatic accepted an address outside every pool")
+	}
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// 支持的密钥算法，用于 CA、服务器和客户端证书
+const (
+	KeyTypeRSA2048   = "rsa2048"
+	KeyTypeRSA3072   = "rsa3072"
+	KeyTypeRSA4096   = "rsa4096"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+
+	// DefaultKeyType 是未指定算法时客户端使用的密钥类型，握手开销比 RSA 小得多
+	DefaultKeyType = KeyTypeECDSAP256
+)
+
+// KeyTypes 按推荐顺序列出所有支持的密钥类型
+var KeyTypes = []string{KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519, KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096}
+
+// GenerateKey 按密钥类型生成私钥，keyType 为空时使用 DefaultKeyType
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "":
+		return GenerateKey(DefaultKeyType)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// KeyTypeOf 返回公钥对应的密钥类型，不支持的算法或强度返回空字符串
+func KeyTypeOf(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048
+		case 3072:
+			return KeyTypeRSA3072
+		case 4096:
+			return KeyTypeRSA4096
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256
+		case elliptic.P384():
+			return KeyTypeECDSAP384
+		}
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+// ParsePrivateKeyPEM 解析 PEM 编码的私钥，支持 PKCS#1、SEC 1 和 PKCS#8 格式
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || KeyTypeOf(signer.Public()) == "" {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// MarshalPrivateKeyPEM 将私钥编码为 PKCS#8 PEM
+func MarshalPrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	connectip "github.com/iselt/connect-ip-go"
 	"github.com/quic-go/quic-go"
@@ -119,8 +120,96 @@ func ProxyFromTunToVPN(dev *TUNDevice, ipconn *connectip.Conn, errChan chan<- er
 	}
 }
 
+// ConnSwitch 保存当前活动的 CONNECT-IP 连接
+// 客户端重连时只需替换其中的连接，TUN 读取循环无需重启
+type ConnSwitch struct {
+	conn atomic.Pointer[connectip.Conn]
+}
+
+// Set 替换当前连接，传入 nil 表示暂无可用连接
+func (s *ConnSwitch) Set(conn *connectip.Conn) {
+	s.conn.Store(conn)
+}
+
+// Load 返回当前连接，可能为 nil
+func (s *ConnSwitch) Load() *connectip.Conn {
+	return s.conn.Load()
+}
+
+// ProxyFromTunToSwitch 从TUN设备批量读取数据包并发送到 ConnSwitch 当前的连接
+// 与 ProxyFromTunToVPN 不同，连接断开不会结束循环：没有可用连接或写入失败时丢弃数据包，
+// 仅在TUN设备关闭或读取出错时返回
+func ProxyFromTunToSwitch(dev *TUNDevice, sw *ConnSwitch, errChan chan<- error) {
+	batchSize := dev.BatchSize()
+	if batchSize <= 0 {
+		batchSize = 32 // 默认批量大小
+	}
+
+	packetBufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	for i := range packetBufs {
+		packetBufs[i] = make([]byte, BufferSize)
+	}
+
+	for {
+		n, err := dev.Read(packetBufs, sizes, 0)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+				log.Println("TUN device closed, stopping Tun->VPN proxy.")
+				errChan <- nil
+				return
+			}
+
+			if errors.Is(err, tun.ErrTooManySegments) {
+				log.Println("Warning: Too many segments in TUN device read, continuing...")
+				continue
+			}
+
+			errChan <- fmt.Errorf("failed to read batch from TUN device %s: %w", dev.Name(), err)
+			return
+		}
+
+		ipconn := sw.Load()
+		if ipconn == nil {
+			continue // 正在重连，丢弃这批数据包
+		}
+
+		for i := 0; i < n; i++ {
+			icmp, writeErr := ipconn.WritePacket(packetBufs[i][:sizes[i]])
+			if writeErr != nil {
+				// 连接已断开，由 VPN->TUN 方向负责报告错误并触发重连
+				break
+			}
+			if len(icmp) > 0 {
+				WriteICMPToTun(dev, icmp)
+			}
+		}
+	}
+}
+
+// WriteICMPToTun 将 CONNECT-IP 连接返回的 ICMP 报文写回TUN设备
+// 报文会被复制到预留了 virtio-net 头部的缓冲区中
+func WriteICMPToTun(dev *TUNDevice, icmp []byte) {
+	buf := make([]byte, VirtioNetHdrLen+len(icmp))
+	copy(buf[VirtioNetHdrLen:], icmp)
+	if _, err := dev.WritePacket(buf, VirtioNetHdrLen); err != nil {
+		if !errors.Is(err, os.ErrClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Warning: Unable to write ICMP packet to TUN device %s: %v", dev.Name(), err)
+		}
+	}
+}
+
+// PacketInterceptor 在数据包写入TUN设备之前调用，返回 true 表示数据包已被处理，不再写入TUN设备
+// packet 所在的缓冲区会被复用，需要保留时必须复制
+type PacketInterceptor func(packet []byte) bool
+
 // ProxyFromVPNToTun 从VPN连接读取数据包并写入TUN设备
 func ProxyFromVPNToTun(dev *TUNDevice, ipconn *connectip.Conn, errChan chan<- error) {
+	ProxyFromVPNToTunWithInterceptor(dev, ipconn, nil, errChan)
+}
+
+// ProxyFromVPNToTunWithInterceptor 与 ProxyFromVPNToTun 相同，但每个数据包先交给 intercept 处理
+func ProxyFromVPNToTunWithInterceptor(dev *TUNDevice, ipconn *connectip.Conn, intercept PacketInterceptor, errChan chan<- error) {
 	for {
 		// 从池中获取预先准备好virtio头的缓冲区
 		buf := vpnToTunBufferPool.Get().([]byte)
@@ -140,7 +229,7 @@ func ProxyFromVPNToTun(dev *TUNDevice, ipconn *connectip.Conn, errChan chan<- er
 			return
 		}
 
-		if n == 0 {
+		if n == 0 || (intercept != nil && intercept(buf[VirtioNetHdrLen:VirtioNetHdrLen+n])) {
 			vpnToTunBufferPool.Put(buf) // 归还缓冲区
 			continue
 		}
@@ -11,6 +11,7 @@ import (
 	"os/exec"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
@@ -22,6 +23,7 @@ type TUNDevice struct {
 	ipAddress netip.Addr   // IP地址
 	index     int          // 接口索引（Linux使用）
 	link      netlink.Link // Linux网络接口
+	dnsMode   string       // 当前 DNS 配置方式，RevertDNS 据此恢复
 }
 
 // SetIP 设置TUN设备的IP地址为网关IP
@@ -57,6 +59,27 @@ func (t *TUNDevice) SetIP(ipPrefix netip.Prefix) error {
 	return nil
 }
 
+// AddAddress 为TUN设备追加一个地址，用于在同一设备上配置双栈地址
+func (t *TUNDevice) AddAddress(ipPrefix netip.Prefix) error {
+	if t.link == nil {
+		link, err := netlink.LinkByName(t.name)
+		if err != nil {
+			return fmt.Errorf("failed to get interface %s: %v", t.name, err)
+		}
+		t.link = link
+	}
+
+	addr := &netlink.Addr{
+		IPNet: PrefixToIPNet(ipPrefix),
+	}
+	if err := netlink.AddrAdd(t.link, addr); err != nil {
+		return fmt.Errorf("failed to add IP address %s: %v", ipPrefix, err)
+	}
+
+	log.Printf("Added IP %s to TUN device %s", ipPrefix, t.name)
+	return nil
+}
+
 // AddRoute 通过TUN设备添加路由
 func (t *TUNDevice) AddRoute(prefix netip.Prefix) error {
 	// 创建IP地址
@@ -80,6 +103,96 @@ func (t *TUNDevice) AddRoute(prefix netip.Prefix) error {
 	return nil
 }
 
+// RemoveAddress 删除TUN设备上的地址
+func (t *TUNDevice) RemoveAddress(ipPrefix netip.Prefix) error {
+	if err := netlink.AddrDel(t.link, &netlink.Addr{IPNet: PrefixToIPNet(ipPrefix)}); err != nil {
+		return fmt.Errorf("failed to remove IP address %s: %v", ipPrefix, err)
+	}
+	log.Printf("Removed IP %s from TUN device %s", ipPrefix, t.name)
+	return nil
+}
+
+// RemoveRoute 删除通过TUN设备添加的路由
+func (t *TUNDevice) RemoveRoute(prefix netip.Prefix) error {
+	route := &netlink.Route{
+		LinkIndex: t.index,
+		Dst:       PrefixToIPNet(prefix.Masked()),
+		Priority:  1, // 与 AddRoute 保持一致
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("failed to remove route: %v", err)
+	}
+	return nil
+}
+
+// ListRoutes 返回主路由表中经由TUN设备的路由，不含内核为设备地址自动生成的路由
+func (t *TUNDevice) ListRoutes() ([]netip.Prefix, error) {
+	routes, err := netlink.RouteList(t.link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	var prefixes []netip.Prefix
+	for _, r := range routes {
+		if r.Dst == nil || r.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(r.Dst.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := r.Dst.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), ones))
+	}
+	return prefixes, nil
+}
+
+// BypassRoute 是经由原有网关到达指定地址的主机路由
+// 全隧道模式下用于固定到服务器的路径，避免隧道自身的 QUIC 数据包被路由进隧道
+type BypassRoute struct {
+	dst   netip.Addr
+	route netlink.Route
+}
+
+// AddBypassRoute 查询当前到 dst 的路由，并按相同的网关和出口接口添加一条主机路由
+// dev 不为空时，如果当前路由已经经过该 TUN 设备则返回错误
+func AddBypassRoute(dst netip.Addr, dev *TUNDevice) (*BypassRoute, error) {
+	routes, err := netlink.RouteGet(dst.AsSlice())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up route to %s: %v", dst, err)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no route to %s", dst)
+	}
+	if dev != nil && routes[0].LinkIndex == dev.index {
+		return nil, fmt.Errorf("route to %s already goes through TUN device %s", dst, dev.name)
+	}
+
+	route := netlink.Route{
+		LinkIndex: routes[0].LinkIndex,
+		Dst:       PrefixToIPNet(netip.PrefixFrom(dst, dst.BitLen())),
+		Gw:        routes[0].Gw,
+	}
+	if err := netlink.RouteReplace(&route); err != nil {
+		return nil, fmt.Errorf("failed to add bypass route to %s: %v", dst, err)
+	}
+	log.Printf("Added bypass route to %s via %v (link %d)", dst, route.Gw, route.LinkIndex)
+	return &BypassRoute{dst: dst, route: route}, nil
+}
+
+// Addr 返回主机路由的目标地址
+func (r *BypassRoute) Addr() netip.Addr {
+	return r.dst
+}
+
+// Remove 删除主机路由
+func (r *BypassRoute) Remove() error {
+	if err := netlink.RouteDel(&r.route); err != nil {
+		return fmt.Errorf("failed to remove bypass route to %s: %v", r.dst, err)
+	}
+	log.Printf("Removed bypass route to %s", r.dst)
+	return nil
+}
+
 // CreateTunDevice 在Linux上创建和配置TUN设备
 func CreateTunDevice(name string, ipPrefix netip.Prefix, mtu int) (*TUNDevice, error) {
 	// 如果名称为空，则使用默认名称
@@ -127,6 +240,13 @@ func CreateTunDevice(name string, ipPrefix netip.Prefix, mtu int) (*TUNDevice, e
 	return tunDevice, nil
 }
 
+// EnableForwarding 允许经由TUN设备转发数据包（客户端作为子网路由器时使用）
+// Linux上转发是全局开关，创建设备时已经启用，这里再次确认
+func (t *TUNDevice) EnableForwarding() error {
+	enableIPForwarding()
+	return nil
+}
+
 // enableIPForwarding 启用Linux内核IP转发
 func enableIPForwarding() {
 	// 启用IPv4转发
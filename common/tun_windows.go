@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"log"
 	"net/netip"
+	"sync"
 
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
@@ -20,6 +22,10 @@ type TUNDevice struct {
 	ipAddress netip.Addr    // IP地址
 	index     int           // 接口索引（Linux使用）
 	luid      winipcfg.LUID // LUID（Windows使用）
+
+	// 添加路由时使用的下一跳，删除时必须与之一致；设备地址变化后不能重新推算
+	routesMu  sync.Mutex
+	routeHops map[netip.Prefix]netip.Addr
 }
 
 // LUID 返回Windows网络接口的LUID
@@ -38,16 +44,192 @@ func (t *TUNDevice) SetIP(ipPrefix netip.Prefix) error {
 	return nil
 }
 
+// AddAddress 为TUN设备追加一个地址，用于在同一设备上配置双栈地址
+func (t *TUNDevice) AddAddress(ipPrefix netip.Prefix) error {
+	if err := t.luid.AddIPAddress(ipPrefix); err != nil {
+		return fmt.Errorf("failed to add IP address %s: %v", ipPrefix, err)
+	}
+	if !t.ipAddress.IsValid() {
+		t.ipAddress = ipPrefix.Addr()
+	}
+	log.Printf("Added IP %s to TUN device %s", ipPrefix, t.name)
+	return nil
+}
+
+// RemoveAddress 删除TUN设备上的地址
+func (t *TUNDevice) RemoveAddress(ipPrefix netip.Prefix) error {
+	if err := t.luid.DeleteIPAddress(ipPrefix); err != nil {
+		return fmt.Errorf("failed to remove IP address %s: %v", ipPrefix, err)
+	}
+	if ipPrefix.Addr() == t.ipAddress {
+		t.ipAddress = netip.Addr{}
+	}
+	log.Printf("Removed IP %s from TUN device %s", ipPrefix, t.name)
+	return nil
+}
+
+// routeNextHop 返回路由使用的下一跳
+func (t *TUNDevice) routeNextHop(prefix netip.Prefix) netip.Addr {
+	nextHop := t.ipAddress
+	// 下一跳必须与路由属于同一地址族，否则使用未指定地址（直连）
+	if !nextHop.IsValid() || nextHop.Is4() != prefix.Addr().Is4() {
+		if prefix.Addr().Is4() {
+			nextHop = netip.IPv4Unspecified()
+		} else {
+			nextHop = netip.IPv6Unspecified()
+		}
+	}
+	return nextHop
+}
+
+// RemoveRoute 删除通过TUN设备添加的路由，使用添加时记录的下一跳
+// 不是由本设备对象添加的路由（例如上次运行残留的路由）按系统路由表中的记录删除
+func (t *TUNDevice) RemoveRoute(prefix netip.Prefix) error {
+	t.routesMu.Lock()
+	defer t.routesMu.Unlock()
+	nextHop, ok := t.routeHops[prefix]
+	if !ok {
+		return t.removeRouteFromTable(prefix)
+	}
+	if err := t.luid.DeleteRoute(prefix, nextHop); err != nil {
+		return fmt.Errorf("failed to remove route: %v", err)
+	}
+	delete(t.routeHops, prefix)
+	return nil
+}
+
+// removeRouteFromTable 删除系统路由表中该设备上目标为 prefix 的所有路由
+func (t *TUNDevice) removeRouteFromTable(prefix netip.Prefix) error {
+	table, err := winipcfg.GetIPForwardTable2(winipcfg.AddressFamily(windows.AF_UNSPEC))
+	if err != nil {
+		return fmt.Errorf("failed to remove route: %v", err)
+	}
+	for i := range table {
+		row := &table[i]
+		if row.InterfaceLUID != t.luid || row.DestinationPrefix.Prefix() != prefix {
+			continue
+		}
+		if err := row.Delete(); err != nil {
+			return fmt.Errorf("failed to remove route: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListRoutes 返回经由TUN设备添加的路由，不含系统为设备地址自动生成的路由
+func (t *TUNDevice) ListRoutes() ([]netip.Prefix, error) {
+	table, err := winipcfg.GetIPForwardTable2(winipcfg.AddressFamily(windows.AF_UNSPEC))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	var prefixes []netip.Prefix
+	for i := range table {
+		row := &table[i]
+		if row.InterfaceLUID != t.luid || row.Protocol == winipcfg.RouteProtocolLocal {
+			continue
+		}
+		prefixes = append(prefixes, row.DestinationPrefix.Prefix())
+	}
+	return prefixes, nil
+}
+
 // AddRoute 通过TUN设备添加路由
 func (t *TUNDevice) AddRoute(prefix netip.Prefix) error {
-	nextHop := t.ipAddress
 	metric := uint32(1)
 
+	t.routesMu.Lock()
+	defer t.routesMu.Unlock()
+	nextHop := t.routeNextHop(prefix)
 	err := t.luid.AddRoute(prefix, nextHop, metric)
 	if err != nil {
 		return fmt.Errorf("failed to add route: %v", err)
 	}
+	if t.routeHops == nil {
+		t.routeHops = make(map[netip.Prefix]netip.Addr)
+	}
+	t.routeHops[prefix] = nextHop
+
+	return nil
+}
+
+// EnableForwarding 允许经由TUN设备转发数据包（客户端作为子网路由器时使用）
+// Windows上转发按接口设置，局域网一侧的接口需要另行开启转发
+func (t *TUNDevice) EnableForwarding() error {
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		iface, err := t.luid.IPInterface(family)
+		if err != nil {
+			return fmt.Errorf("failed to get IP interface: %v", err)
+		}
+		iface.ForwardingEnabled = true
+		if err := iface.Set(); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+	log.Printf("Forwarding enabled on TUN device %s", t.name)
+	return nil
+}
+
+// BypassRoute 是经由原有网关到达指定地址的主机路由
+// 全隧道模式下用于固定到服务器的路径，避免隧道自身的 QUIC 数据包被路由进隧道
+type BypassRoute struct {
+	dst     netip.Addr
+	luid    winipcfg.LUID
+	nextHop netip.Addr
+}
+
+// AddBypassRoute 在路由表中查找到 dst 的最佳路由（忽略 dev 上的路由），并按相同的网关和接口添加一条主机路由
+func AddBypassRoute(dst netip.Addr, dev *TUNDevice) (*BypassRoute, error) {
+	family := winipcfg.AddressFamily(windows.AF_INET)
+	if dst.Is6() {
+		family = winipcfg.AddressFamily(windows.AF_INET6)
+	}
+	table, err := winipcfg.GetIPForwardTable2(family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get route table: %v", err)
+	}
+
+	var best *winipcfg.MibIPforwardRow2
+	for i := range table {
+		row := &table[i]
+		if dev != nil && row.InterfaceLUID == dev.luid {
+			continue
+		}
+		prefix := row.DestinationPrefix.Prefix()
+		if !prefix.Contains(dst) {
+			continue
+		}
+		if best == nil {
+			best = row
+			continue
+		}
+		bestBits := best.DestinationPrefix.Prefix().Bits()
+		if prefix.Bits() > bestBits || (prefix.Bits() == bestBits && row.Metric < best.Metric) {
+			best = row
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no route to %s", dst)
+	}
+
+	r := &BypassRoute{dst: dst, luid: best.InterfaceLUID, nextHop: best.NextHop.Addr()}
+	if err := r.luid.AddRoute(netip.PrefixFrom(dst, dst.BitLen()), r.nextHop, 0); err != nil {
+		return nil, fmt.Errorf("failed to add bypass route to %s: %v", dst, err)
+	}
+	log.Printf("Added bypass route to %s via %s", dst, r.nextHop)
+	return r, nil
+}
 
+// Addr 返回主机路由的目标地址
+func (r *BypassRoute) Addr() netip.Addr {
+	return r.dst
+}
+
+// Remove 删除主机路由
+func (r *BypassRoute) Remove() error {
+	if err := r.luid.DeleteRoute(netip.PrefixFrom(r.dst, r.dst.BitLen()), r.nextHop); err != nil {
+		return fmt.Errorf("failed to remove bypass route to %s: %v", r.dst, err)
+	}
+	log.Printf("Removed bypass route to %s", r.dst)
 	return nil
 }
 
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// needsEnrollment 配置中没有客户端证书但提供了注册令牌时，需要先完成注册
+func needsEnrollment() bool {
+	return !hasInlineCert() && (clientConfig.TLSCert == "" || clientConfig.TLSKey == "") && clientConfig.EnrollToken != ""
+}
+
+// hasInlineCert 判断配置中是否内嵌了证书和私钥（待注册的配置中两者为空）
+func hasInlineCert() bool {
+	return strings.TrimSpace(clientConfig.CertPEM) != "" && strings.TrimSpace(clientConfig.KeyPEM) != ""
+}
+
+// enroll 在本机生成私钥，凭一次性令牌向服务器提交 CSR，把签发的证书和私钥写回配置并清空令牌
+func enroll(ctx context.Context) error {
+	if clientConfig.EnrollURL == "" {
+		return errors.New("enroll_url must be set to use enroll_token")
+	}
+	key, err := common.GenerateKey(clientConfig.KeyType)
+	if err != nil {
+		return err
+	}
+	// CN 由服务器根据令牌填写
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+	reqBody, err := json.Marshal(map[string]string{
+		"token": clientConfig.EnrollToken,
+		"csr":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, clientConfig.EnrollURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Printf("Enrolling with %s...", clientConfig.EnrollURL)
+	resp, err := enrollHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ClientID string `json:"client_id"`
+		CertPEM  string `json:"cert_pem"`
+		Error    string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return fmt.Errorf("invalid enrollment response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, result.Error)
+	}
+
+	keyPEM, err := common.MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if _, err := tls.X509KeyPair([]byte(result.CertPEM), keyPEM); err != nil {
+		return fmt.Errorf("server returned an invalid certificate: %w", err)
+	}
+	if err := saveCertificate([]byte(result.CertPEM), keyPEM); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+	if err := clearEnrollToken(); err != nil {
+		log.Printf("Warning: failed to clear enroll_token in %s: %v", clientConfigPath, err)
+	}
+	log.Printf("Enrolled as client %s", result.ClientID)
+	return nil
+}
+
+// enrollHTTPClient 返回注册使用的 HTTP 客户端，信任系统根证书以及配置中的 CA
+func enrollHTTPClient() *http.Client {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if clientConfig.CAPEM != "" {
+		pool.AppendCertsFromPEM([]byte(clientConfig.CAPEM))
+	} else if clientConfig.CAFile != "" {
+		if caCert, err := os.ReadFile(clientConfig.CAFile); err == nil {
+			pool.AppendCertsFromPEM(caCert)
+		}
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, InsecureSkipVerify: clientConfig.InsecureSkipVerify},
+		},
+	}
+}
+
+// clearEnrollToken 注册成功后清空配置文件中已使用的令牌
+func clearEnrollToken() error {
+	content, err := os.ReadFile(clientConfigPath)
+	if err != nil {
+		return err
+	}
+	re := regexp.MustCompile(`(?m)^(\s*enroll_token\s*=\s*)"[^"]*"`)
+	if !re.Match(content) {
+		return nil
+	}
+	clientConfig.EnrollToken = ""
+	return writeFileAtomic(clientConfigPath, re.ReplaceAll(content, []byte(`${1}""`)), 0600)
+}
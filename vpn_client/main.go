@@ -4,16 +4,20 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"slices"
 	"strconv"
 	"sync"
 	"syscall"
@@ -29,6 +33,245 @@ import (
 
 var clientConfig common.ClientConfig
 
+// 重连退避参数
+const (
+	reconnectInitialDelay = 1 * time.Second  // 首次重连等待时间
+	reconnectMaxDelay     = 60 * time.Second // 最大重连等待时间
+	stableSessionDuration = 60 * time.Second // 会话持续超过该时间后重置退避
+)
+
+// vpnSession 表示一次 QUIC + CONNECT-IP 会话，重连时整体替换
+type vpnSession struct {
+	udpConn   *net.UDPConn
+	quicConn  quic.Connection
+	ipConn    *connectip.Conn
+	h3Conn    *http3.ClientConn
+	serverIP  netip.Addr // 服务器的实际地址，用于判断路由是否覆盖服务器
+	closeOnce sync.Once
+}
+
+// Close 关闭 CONNECT-IP 连接、QUIC 连接和底层 UDP socket
+func (s *vpnSession) Close() {
+	s.closeOnce.Do(func() {
+		if s.ipConn != nil {
+			s.ipConn.Close()
+		}
+		if s.quicConn != nil {
+			s.quicConn.CloseWithError(0, "")
+		}
+		if s.udpConn != nil {
+			s.udpConn.Close()
+		}
+	})
+}
+
+// tunState 保存跨重连保留的 TUN 设备状态
+// 服务器分配的地址变化时原地调整设备，只有调整失败时才会重建设备
+type tunState struct {
+	mu       sync.Mutex // 会话期间串行化地址和路由更新
+	dev      *common.TUNDevice
+	prefixes []netip.Prefix            // 设备上配置的地址（双栈时每个地址族一个）
+	routes   map[netip.Prefix]struct{} // 已通过 TUN 设备安装的路由
+	sw       common.ConnSwitch         // TUN->VPN 方向当前使用的连接
+	tunErr   chan error                // TUN->VPN 读取循环退出通知
+	bypass   *common.BypassRoute       // 通告的路由覆盖服务器地址时，经由原网关到服务器的主机路由
+	subnets  []netip.Prefix            // 本机背后的路由子网
+	dns      common.DNSConfig          // 已应用到设备上的 DNS 配置
+}
+
+func newTunState() *tunState {
+	return &tunState{routes: make(map[netip.Prefix]struct{})}
+}
+
+// closeDevice 删除安装的路由后关闭 TUN 设备，恢复原有路由表
+func (s *tunState) closeDevice() {
+	if s.dev == nil {
+		return
+	}
+	s.sw.Set(nil)
+	if !s.dns.IsEmpty() {
+		if err := s.dev.RevertDNS(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		s.dns = common.DNSConfig{}
+	}
+	s.removeRoutes()
+	s.dev.Close()
+	if s.tunErr != nil {
+		<-s.tunErr // 等待读取循环退出
+		s.tunErr = nil
+	}
+	s.dev = nil
+	s.prefixes = nil
+	s.subnets = nil
+	// 隧道路由删除后，再删除到服务器的主机路由
+	if s.bypass != nil {
+		if err := s.bypass.Remove(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		s.bypass = nil
+	}
+}
+
+// splitAssignedPrefixes 拆分服务器分配的前缀
+// 主机前缀（/32、/128）是客户端自己的地址（双栈时每个地址族一个），排序后配置到 TUN 设备上；
+// 更短的前缀是分配给本客户端的路由子网，位于本机局域网一侧，由本机负责转发，不配置到 TUN 设备
+func splitAssignedPrefixes(prefixes []netip.Prefix) (addrs, subnets []netip.Prefix) {
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			addrs = append(addrs, prefix)
+		} else {
+			subnets = append(subnets, prefix)
+		}
+	}
+	slices.SortFunc(addrs, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+	return addrs, subnets
+}
+
+// applyAddresses 将 TUN 设备上的地址调整为 prefixes：先添加新地址，再删除旧地址
+func (s *tunState) applyAddresses(prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		if !slices.Contains(s.prefixes, prefix) {
+			if err := s.dev.AddAddress(prefix); err != nil {
+				return err
+			}
+		}
+	}
+	for _, prefix := range s.prefixes {
+		if !slices.Contains(prefixes, prefix) {
+			if err := s.dev.RemoveAddress(prefix); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	s.prefixes = prefixes
+	return nil
+}
+
+// applySubnets 记录本机背后的路由子网，出现新子网时开启转发
+func (s *tunState) applySubnets(subnets []netip.Prefix) {
+	if slices.Equal(s.subnets, subnets) {
+		return
+	}
+	s.subnets = subnets
+	if len(subnets) == 0 {
+		return
+	}
+	log.Printf("Routing subnets %v behind this client, forwarding LAN traffic", subnets)
+	if err := s.dev.EnableForwarding(); err != nil {
+		log.Printf("Warning: failed to enable forwarding: %v", err)
+	}
+}
+
+// applyDNS 将服务器下发的 DNS 配置应用到设备，配置未变化时不做处理
+func (s *tunState) applyDNS(cfg common.DNSConfig) {
+	if cfg.Equal(s.dns) {
+		return
+	}
+	if err := s.dev.SetDNS(cfg); err != nil {
+		log.Printf("Warning: failed to configure DNS: %v", err)
+		return
+	}
+	s.dns = cfg
+}
+
+// applyRoutes 将通过 TUN 设备安装的路由调整为服务器通告的路由：添加新路由，删除不再通告的路由
+func (s *tunState) applyRoutes(routes []connectip.IPRoute, serverIP netip.Addr) {
+	desired := make(map[netip.Prefix]struct{})
+	for _, route := range routes {
+		log.Printf("Processing route: Start=%s, End=%s, Proto=%d", route.StartIP, route.EndIP, route.IPProtocol)
+		for _, prefix := range splitDefaultRoutes(route.Prefixes()) {
+			desired[prefix] = struct{}{}
+		}
+	}
+
+	added, removed := 0, 0
+	for prefix := range desired {
+		// 已经安装的路由（例如重连后复用的设备）无需重复添加
+		if _, ok := s.routes[prefix]; ok {
+			continue
+		}
+
+		// 路由覆盖服务器地址时（例如全隧道），先经由原网关固定到服务器的主机路由
+		if prefix.Contains(serverIP) && s.bypass == nil {
+			bypass, err := common.AddBypassRoute(serverIP, s.dev)
+			if err != nil {
+				log.Printf("Warning: skipping route %s, it covers the server address and no bypass route could be added: %v", prefix, err)
+				continue
+			}
+			s.bypass = bypass
+		}
+
+		// 直接使用TUN设备对象添加路由
+		if err := s.dev.AddRoute(prefix); err != nil {
+			log.Printf("Warning: failed to add route for %s: %v", prefix, err)
+			continue
+		}
+		log.Printf("Added route: %s via %s", prefix, s.dev.Name())
+		s.routes[prefix] = struct{}{}
+		added++
+	}
+	for prefix := range s.routes {
+		if _, ok := desired[prefix]; ok {
+			continue
+		}
+		if err := s.dev.RemoveRoute(prefix); err != nil {
+			log.Printf("Warning: failed to remove route for %s: %v", prefix, err)
+		} else {
+			log.Printf("Removed route: %s via %s", prefix, s.dev.Name())
+		}
+		delete(s.routes, prefix)
+		removed++
+	}
+
+	// 不再有路由覆盖服务器地址时，删除到服务器的主机路由
+	if s.bypass != nil && !s.routesCover(s.bypass.Addr()) {
+		if err := s.bypass.Remove(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		s.bypass = nil
+	}
+	log.Printf("Applied server's route advertisement: %d routes added, %d removed", added, removed)
+}
+
+// removeRoutes 逐条删除通过 TUN 设备安装的路由，不依赖设备关闭时内核的隐式清理
+func (s *tunState) removeRoutes() {
+	for prefix := range s.routes {
+		if err := s.dev.RemoveRoute(prefix); err != nil {
+			log.Printf("Warning: failed to remove route for %s: %v", prefix, err)
+		} else {
+			log.Printf("Removed route: %s via %s", prefix, s.dev.Name())
+		}
+	}
+	s.routes = make(map[netip.Prefix]struct{})
+}
+
+// syncRoutes 将记录的路由与设备上实际存在的路由对齐
+// 被外部删除的路由不再视为已安装，随后由 applyRoutes 重新添加
+func (s *tunState) syncRoutes() {
+	installed, err := s.dev.ListRoutes()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	for prefix := range s.routes {
+		if !slices.Contains(installed, prefix) {
+			log.Printf("Route %s is missing from TUN device %s", prefix, s.dev.Name())
+			delete(s.routes, prefix)
+		}
+	}
+}
+
+// routesCover 判断已安装的路由是否覆盖 addr
+func (s *tunState) routesCover(addr netip.Addr) bool {
+	for prefix := range s.routes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	if os.Getenv("PERF_PROFILE") != "" {
 		f, _ := os.OpenFile("cpu.pprof", os.O_CREATE|os.O_RDWR, 0666)
@@ -42,6 +285,7 @@ func main() {
 	if _, err := toml.DecodeFile(*configFile, &clientConfig); err != nil {
 		log.Fatalf("Error loading config file %s: %v", *configFile, err)
 	}
+	clientConfigPath = *configFile
 
 	// --- 基础验证 ---
 	if clientConfig.ServerAddr == "" || clientConfig.ServerName == "" {
@@ -55,70 +299,137 @@ func main() {
 		log.Println("WARNING: Skipping TLS server verification!")
 	}
 
+	// --- 首次注册：本机生成私钥并提交 CSR ---
+	if needsEnrollment() {
+		enrollCtx, enrollCancel := context.WithTimeout(context.Background(), time.Minute)
+		err := enroll(enrollCtx)
+		enrollCancel()
+		if err != nil {
+			log.Fatalf("Enrollment failed: %v", err)
+		}
+	}
+
+	// --- TLS 配置（只加载一次，重连时复用） ---
+	tlsConfig, keyLogWriter, err := buildTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to load TLS configuration: %v", err)
+	}
+	if keyLogWriter != nil {
+		defer keyLogWriter.Close()
+	}
+
 	// --- 创建用于优雅关闭的 Context ---
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	var wg sync.WaitGroup
-	var tunDev *common.TUNDevice
-	var ipConn *connectip.Conn
+	// 恢复上次异常退出时遗留的 DNS 配置
+	common.RecoverDNS()
 
-	// --- 建立连接并配置 TUN 设备 ---
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var err error
-		tunDev, ipConn, err = establishAndConfigure(ctx)
+	// --- 连接监督循环：断线后按指数退避自动重连 ---
+	state := newTunState()
+	runSupervisor(ctx, tlsConfig, state)
+
+	// --- 清理 ---
+	log.Println("Closing TUN device...")
+	state.closeDevice()
+	log.Println("VPN Client exited.")
+}
+
+// runSupervisor 循环建立会话，直到 ctx 被取消
+// 每次失败或断线后按指数退避并加入随机抖动再重连，会话稳定运行一段时间后重置退避
+func runSupervisor(ctx context.Context, tlsConfig *tls.Config, state *tunState) {
+	backoff := reconnectInitialDelay
+	for {
+		started := time.Now()
+		session, err := establishAndConfigure(ctx, tlsConfig, state)
 		if err != nil {
 			log.Printf("Failed to establish connection: %v", err)
-			stop() // Signal main goroutine to exit if setup fails
+		} else {
+			log.Println("Connection established and TUN device configured.")
+			runSession(ctx, session, state)
+			session.Close()
+		}
+
+		if ctx.Err() != nil {
 			return
 		}
-		log.Println("Connection established and TUN device configured.")
-		// --- 启动代理 Goroutine ---
-		errChan := make(chan error, 2)
-		var proxyWg sync.WaitGroup
-
-		proxyWg.Add(2)
-		go func() {
-			defer proxyWg.Done()
-			common.ProxyFromTunToVPN(tunDev, ipConn, errChan)
-		}()
-		go func() {
-			defer proxyWg.Done()
-			common.ProxyFromVPNToTun(tunDev, ipConn, errChan)
-		}()
-
-		// --- 等待错误或关闭信号 ---
+		if err == nil && time.Since(started) > stableSessionDuration {
+			backoff = reconnectInitialDelay
+		}
+
+		wait := withJitter(backoff)
+		log.Printf("Reconnecting in %s...", wait.Round(time.Millisecond))
 		select {
-		case err := <-errChan:
-			log.Printf("Proxying error: %v", err)
 		case <-ctx.Done():
-			log.Println("Shutdown signal received, stopping proxy...")
+			return
+		case <-time.After(wait):
 		}
+		backoff = min(backoff*2, reconnectMaxDelay)
+	}
+}
 
-		// --- 清理 ---
-		log.Println("Closing connection and TUN device...")
-		if ipConn != nil {
-			ipConn.Close()
-		}
-		if tunDev != nil {
-			tunDev.Close() // Closing the TUN device should unblock reads/writes
-		}
+// withJitter 返回 [d/2, d) 范围内的随机时长，避免大量客户端同时重连
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// runSession 在会话上转发数据，直到连接断开、TUN 设备出错或收到关闭信号
+func runSession(ctx context.Context, session *vpnSession, state *tunState) {
+	sessionCtx, cancel := context.WithCancel(ctx)
+
+	// --- 添加持续监听地址和路由更新的协程，会话结束前等待其退出，避免与下次连接的设备配置并发 ---
+	var monitorWg sync.WaitGroup
+	monitorWg.Add(2)
+	go func() {
+		defer monitorWg.Done()
+		monitorAddressAndRouteUpdates(sessionCtx, session, state)
+	}()
+	go func() {
+		defer monitorWg.Done()
+		maintainCertificate(sessionCtx, session)
+	}()
+	defer func() {
+		cancel()
+		monitorWg.Wait()
+	}()
+
+	// --- 启动代理：TUN->VPN 读取循环跨会话复用，这里只切换连接 ---
+	state.sw.Set(session.ipConn)
+	defer state.sw.Set(nil)
 
-		// Wait for proxy goroutines to finish
-		proxyWg.Wait()
-		log.Println("Proxy goroutines finished.")
+	errChan := make(chan error, 1)
+	var proxyWg sync.WaitGroup
+	proxyWg.Add(1)
+	go func() {
+		defer proxyWg.Done()
+		common.ProxyFromVPNToTun(state.dev, session.ipConn, errChan)
 	}()
 
-	// Wait for the main goroutine (establishAndConfigure + proxying) to finish or be signaled
-	wg.Wait()
-	log.Println("VPN Client exited.")
+	// --- 等待错误或关闭信号 ---
+	select {
+	case err := <-errChan:
+		log.Printf("Proxying stopped: %v", err)
+	case err := <-state.tunErr:
+		// TUN 读取循环已退出，设备不可用，下次连接时重建
+		log.Printf("TUN device error: %v", err)
+		cancel()
+		monitorWg.Wait()
+		state.tunErr = nil
+		state.closeDevice()
+	case <-ctx.Done():
+		log.Println("Shutdown signal received, stopping proxy...")
+	}
+
+	log.Println("Closing connection...")
+	session.Close()
+	proxyWg.Wait()
+	log.Println("Proxy goroutines finished.")
 }
 
-// establishAndConfigure 函数，用于连接服务器，设置 TUN 设备和路由
-func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.Conn, error) {
-	// --- TLS 配置 ---
+// buildTLSConfig 根据客户端配置构造 mTLS 配置
+// 如果配置了 key_log_file，同时返回需要在退出时关闭的文件
+func buildTLSConfig() (*tls.Config, io.Closer, error) {
 	tlsConfig := &tls.Config{
 		ServerName:         clientConfig.ServerName,
 		InsecureSkipVerify: clientConfig.InsecureSkipVerify,
@@ -147,34 +458,42 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 		log.Printf("Using custom CA file: %s", clientConfig.CAFile)
 	}
 	// 优先从 PEM 字符串加载证书和密钥
-	if clientConfig.CertPEM != "" && clientConfig.KeyPEM != "" {
+	if hasInlineCert() {
 		cert, err := tls.X509KeyPair([]byte(clientConfig.CertPEM), []byte(clientConfig.KeyPEM))
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to load client certificate/key from config PEM: %w", err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		clientCert.Set(&cert)
 		log.Printf("Loaded client certificate/key from config PEM")
 	} else if clientConfig.TLSCert != "" && clientConfig.TLSKey != "" {
 		cert, err := tls.LoadX509KeyPair(clientConfig.TLSCert, clientConfig.TLSKey)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to load client certificate/key: %w", err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		clientCert.Set(&cert)
 		log.Printf("Loaded client certificate: %s", clientConfig.TLSCert)
 	} else {
 		return nil, nil, fmt.Errorf("tls_cert and tls_key or cert_pem and key_pem must be set in config for mutual TLS authentication")
 	}
+	// 证书续期后新的握手直接使用新证书，无需重建 TLS 配置
+	tlsConfig.GetClientCertificate = clientCert.GetClientCertificate
+	var keyLogWriter *os.File
 	if clientConfig.KeyLogFile != "" {
-		keyLogWriter, err := os.OpenFile(clientConfig.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		var err error
+		keyLogWriter, err = os.OpenFile(clientConfig.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			log.Printf("Warning: failed to create key log file %s: %v", clientConfig.KeyLogFile, err)
-		} else {
-			tlsConfig.KeyLogWriter = keyLogWriter
-			defer keyLogWriter.Close() // Close when function returns error or finishes setup
-			log.Printf("Logging TLS keys to: %s", clientConfig.KeyLogFile)
+			return tlsConfig, nil, nil
 		}
+		tlsConfig.KeyLogWriter = keyLogWriter
+		log.Printf("Logging TLS keys to: %s", clientConfig.KeyLogFile)
+		return tlsConfig, keyLogWriter, nil
 	}
+	return tlsConfig, nil, nil
+}
 
+// dialSession 建立 QUIC 连接并在其上发起 CONNECT-IP 请求
+func dialSession(ctx context.Context, tlsConfig *tls.Config) (*vpnSession, error) {
 	// --- QUIC 连接 ---
 	quicConf := &quic.Config{
 		EnableDatagrams: true,
@@ -186,13 +505,15 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 	// 我们需要一个 UDP socket 来进行拨号
 	udpConn, err := net.ListenUDP("udp", nil) // Let OS choose source IP/port
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to listen on UDP: %w", err)
+		return nil, fmt.Errorf("failed to listen on UDP: %w", err)
 	}
-	// defer udpConn.Close() // Close underlying UDP conn when QUIC conn closes or setup fails
+	session := &vpnSession{udpConn: udpConn}
 
+	// 每次重连都重新解析，服务器地址可能已变化
 	serverUdpAddr, err := net.ResolveUDPAddr("udp", clientConfig.ServerAddr)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve server address %s: %w", clientConfig.ServerAddr, err)
+		session.Close()
+		return nil, fmt.Errorf("failed to resolve server address %s: %w", clientConfig.ServerAddr, err)
 	}
 
 	// 使用带有超时的 context 进行拨号
@@ -201,10 +522,12 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 
 	quicConn, err := quic.Dial(dialCtx, udpConn, serverUdpAddr, tlsConfig, quicConf)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to dial QUIC connection to %s: %w", clientConfig.ServerAddr, err)
+		session.Close()
+		return nil, fmt.Errorf("failed to dial QUIC connection to %s: %w", clientConfig.ServerAddr, err)
 	}
+	session.quicConn = quicConn
+	session.serverIP = serverUdpAddr.AddrPort().Addr().Unmap()
 	log.Printf("QUIC connection established to %s", quicConn.RemoteAddr())
-	// Note: quicConn.Close() will be called implicitly when ipConn.Close() is called later.
 
 	// --- HTTP/3 和 CONNECT-IP ---
 	h3RoundTripper := &http3.Transport{
@@ -213,12 +536,10 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 	}
 	// 创建一个 H3 客户端连接包装器
 	h3ClientConn := h3RoundTripper.NewClientConn(quicConn)
+	session.h3Conn = h3ClientConn
 
 	// 使用配置的服务器名称和端口作为模板
-	// serverHost, serverPortStr, _ := net.SplitHostPort(clientConfig.ServerAddr)
-	_, serverPortStr, _ := net.SplitHostPort(clientConfig.ServerAddr)
-	serverPort, _ := strconv.Atoi(serverPortStr)
-	template := uritemplate.MustNew(fmt.Sprintf("https://%s:%d/vpn", clientConfig.ServerName, serverPort)) // Use configured server name
+	template := uritemplate.MustNew(serverURL("/vpn"))
 
 	log.Printf("Dialing CONNECT-IP via HTTP/3...")
 	connectCtx, connectCancel := context.WithTimeout(ctx, 10*time.Second) // 10 sec connect-ip timeout
@@ -226,16 +547,69 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 
 	ipConn, resp, err := connectip.Dial(connectCtx, h3ClientConn, template)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to dial connect-ip: %w", err)
+		session.Close()
+		return nil, fmt.Errorf("failed to dial connect-ip: %w", err)
 	}
+	session.ipConn = ipConn
 	if resp.StatusCode != http.StatusOK {
 		// 尝试读取 body 获取更多信息
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, nil, fmt.Errorf("connect-ip dial failed, server returned status %d: %s", resp.StatusCode, string(bodyBytes))
+		session.Close()
+		return nil, fmt.Errorf("connect-ip dial failed, server returned status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
-	// resp.Body.Close()
 	log.Printf("CONNECT-IP session established.")
+	return session, nil
+}
+
+// serverURL 使用配置的服务器名称和端口构造服务器上的 URL
+func serverURL(path string) string {
+	_, serverPortStr, _ := net.SplitHostPort(clientConfig.ServerAddr)
+	serverPort, _ := strconv.Atoi(serverPortStr)
+	return fmt.Sprintf("https://%s:%d%s", clientConfig.ServerName, serverPort, path)
+}
+
+// fetchDNSConfig 通过会话的 HTTP/3 连接获取服务器下发的 DNS 配置
+// 不支持该接口的旧版本服务器返回空配置
+func fetchDNSConfig(ctx context.Context, session *vpnSession) (common.DNSConfig, error) {
+	var cfg common.DNSConfig
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL("/dns"), nil)
+	if err != nil {
+		return cfg, err
+	}
+	resp, err := session.h3Conn.RoundTrip(req)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to request DNS configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return cfg, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return cfg, fmt.Errorf("server returned status %d for DNS configuration", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("invalid DNS configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// establishAndConfigure 函数，用于连接服务器，设置 TUN 设备和路由
+// 已有的 TUN 设备在分配的前缀不变时被复用，否则重建
+func establishAndConfigure(ctx context.Context, tlsConfig *tls.Config, state *tunState) (*vpnSession, error) {
+	// 全隧道模式下服务器地址发生变化时，新地址会被路由进旧隧道，先拆除设备恢复原有路由
+	if state.bypass != nil {
+		if addr, err := net.ResolveUDPAddr("udp", clientConfig.ServerAddr); err == nil && addr.AddrPort().Addr().Unmap() != state.bypass.Addr() {
+			log.Printf("Server address changed from %s to %s, rebuilding TUN device", state.bypass.Addr(), addr.IP)
+			state.closeDevice()
+		}
+	}
+
+	session, err := dialSession(ctx, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ipConn := session.ipConn
 
 	// --- 从服务器获取分配的 IP 和路由 ---
 	fetchCtx, fetchCancel := context.WithTimeout(ctx, 5*time.Second)
@@ -244,114 +618,146 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *connectip.C
 	// 获取从服务器分配的网络前缀
 	localPrefixes, err := ipConn.LocalPrefixes(fetchCtx)
 	if err != nil {
-		ipConn.Close()
-		return nil, nil, fmt.Errorf("failed to get assigned network prefix: %w", err)
+		session.Close()
+		return nil, fmt.Errorf("failed to get assigned network prefix: %w", err)
 	}
 
 	if len(localPrefixes) == 0 {
-		ipConn.Close()
-		return nil, nil, errors.New("server did not assign any network prefix")
+		session.Close()
+		return nil, errors.New("server did not assign any network prefix")
 	}
 	log.Printf("Received network prefix: %v", localPrefixes)
 
-	// 新逻辑：直接使用服务器分配的唯一 IP 前缀
-	assignedPrefix := localPrefixes[0]
-	log.Printf("Using assigned TUN IP: %s", assignedPrefix)
-
-	dev, err := common.CreateTunDevice(clientConfig.TunName, assignedPrefix, clientConfig.MTU)
-	if err != nil {
-		ipConn.Close()
-		return nil, nil, fmt.Errorf("failed to create and configure TUN device: %w", err)
+	assignedPrefixes, routedSubnets := splitAssignedPrefixes(localPrefixes)
+	if len(assignedPrefixes) == 0 {
+		session.Close()
+		return nil, errors.New("server did not assign any host address")
+	}
+	log.Printf("Using assigned TUN IP: %v", assignedPrefixes)
+
+	// 复用的设备在分配的地址变化时原地调整，失败时重建
+	if state.dev != nil && !slices.Equal(state.prefixes, assignedPrefixes) {
+		log.Printf("Assigned prefix changed from %v to %v on TUN device %s", state.prefixes, assignedPrefixes, state.dev.Name())
+		if err := state.applyAddresses(assignedPrefixes); err != nil {
+			log.Printf("Failed to update TUN device addresses, rebuilding: %v", err)
+			state.closeDevice()
+		}
+	}
+	if state.dev == nil {
+		dev, err := common.CreateTunDevice(clientConfig.TunName, assignedPrefixes[0], clientConfig.MTU)
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to create and configure TUN device: %w", err)
+		}
+		for _, prefix := range assignedPrefixes[1:] {
+			if err := dev.AddAddress(prefix); err != nil {
+				dev.Close()
+				session.Close()
+				return nil, fmt.Errorf("failed to configure TUN device: %w", err)
+			}
+		}
+		log.Printf("TUN device %s configured with IP %v", dev.Name(), assignedPrefixes)
+		state.dev = dev
+		state.prefixes = assignedPrefixes
+		state.tunErr = make(chan error, 1)
+		go common.ProxyFromTunToSwitch(dev, &state.sw, state.tunErr)
+	} else {
+		log.Printf("Reusing TUN device %s with IP %v", state.dev.Name(), assignedPrefixes)
+		state.syncRoutes()
 	}
-	log.Printf("TUN device %s configured with IP %s", dev.Name(), assignedPrefix)
+	state.applySubnets(routedSubnets)
 
 	routes, err := ipConn.Routes(fetchCtx)
 	if err != nil {
-		ipConn.Close()
-		return nil, nil, fmt.Errorf("failed to get advertised routes: %w", err)
+		session.Close()
+		return nil, fmt.Errorf("failed to get advertised routes: %w", err)
 	}
 
 	log.Printf("Received advertised routes: %v", routes)
-	// 添加服务器通告的路由
-	// var networkPrefix netip.Prefix
-	// if len(localPrefixes) > 0 {
-	// 	// 取第一个前缀作为网络前缀
-	// 	networkPrefix = localPrefixes[0]
-	// }
-	// 添加自己的路由
-	// dev.AddRoute(networkPrefix)
-
-	addedRoutes := 0
-	for _, route := range routes {
-		log.Printf("Processing route: Start=%s, End=%s, Proto=%d", route.StartIP, route.EndIP, route.IPProtocol)
+	state.applyRoutes(routes, session.serverIP)
 
-		for _, prefix := range route.Prefixes() {
-			// 跳过与我们自己的网络前缀匹配的路由
-			// if networkPrefix.IsValid() && networkPrefix.Contains(prefix.Addr()) {
-			// 	log.Printf("Skipping route %s as it's part of our network prefix %s", prefix, networkPrefix)
-			// 	continue
-			// }
-
-			// 直接使用TUN设备对象添加路由
-			if err := dev.AddRoute(prefix); err != nil {
-				log.Printf("Warning: failed to add route for %s: %v", prefix, err)
-			} else {
-				log.Printf("Added route: %s via %s", prefix, dev.Name())
-				addedRoutes++
-			}
-		}
+	// DNS 获取失败不影响隧道本身，保留上一次的配置
+	if dnsConfig, err := fetchDNSConfig(fetchCtx, session); err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		state.applyDNS(dnsConfig)
 	}
-	log.Printf("Added %d routes from server's advertisement", addedRoutes)
 
-	// --- 添加持续监听地址和路由更新的协程 ---
-	continusUpdate := true // 是否持续更新地址和路由
-	if continusUpdate {
-		go monitorAddressAndRouteUpdates(ctx, ipConn, dev)
-	}
+	// 返回活动的会话
+	return session, nil
+}
 
-	// 返回配置的 TUN 设备和活动的 connect-ip 连接
-	return dev, ipConn, nil
+// splitDefaultRoutes 将默认路由拆分为两条 /1 路由（0.0.0.0/1 + 128.0.0.0/1，::/1 + 8000::/1）
+// 它们比原有默认路由更具体，无需修改或删除原有默认路由，设备关闭时随之删除即可恢复
+func splitDefaultRoutes(prefixes []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, prefix := range prefixes {
+		if prefix.Bits() != 0 {
+			result = append(result, prefix)
+			continue
+		}
+		lower := netip.PrefixFrom(prefix.Addr(), 1)
+		upper := prefix.Addr().AsSlice()
+		upper[0] = 0x80
+		upperAddr, _ := netip.AddrFromSlice(upper)
+		log.Printf("Splitting default route %s into %s and %s", prefix, lower, netip.PrefixFrom(upperAddr, 1))
+		result = append(result, lower, netip.PrefixFrom(upperAddr, 1))
+	}
+	return result
 }
 
-// 监控地址和路由更新的协程
-func monitorAddressAndRouteUpdates(ctx context.Context, conn *connectip.Conn, tunDev *common.TUNDevice) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// monitorAddressAndRouteUpdates 持续接收服务器推送的地址和路由更新，并应用到 TUN 设备
+// LocalPrefixes 和 Routes 会阻塞直到收到新的通告，因此分别在独立的循环中调用，直到 ctx 取消或连接关闭
+func monitorAddressAndRouteUpdates(ctx context.Context, session *vpnSession, state *tunState) {
+	var wg sync.WaitGroup
+	wg.Add(2)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			// 检查地址更新
-			checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			localPrefixes, err := conn.LocalPrefixes(checkCtx)
-			cancel()
-
-			if err == nil && len(localPrefixes) > 0 {
-				log.Printf("Checking for IP address updates, current prefixes: %v", localPrefixes)
-				// 这里可以添加处理地址变更的逻辑
-				// 目前仅记录，实际应用中可能需要更新TUN设备地址
-				log.Printf("Current TUN device(%s) IP: %s", tunDev.Name(), localPrefixes[0])
-				// 例如：如果需要更新 TUN 设备的 IP 地址，可以在这里调用 common.CreateTunDevice 函数
+	go func() {
+		defer wg.Done()
+		for {
+			localPrefixes, err := session.ipConn.LocalPrefixes(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Stopped receiving address updates: %v", err)
+				}
+				return
+			}
+			log.Printf("Received address update: %v", localPrefixes)
+			assignedPrefixes, routedSubnets := splitAssignedPrefixes(localPrefixes)
+			if len(assignedPrefixes) == 0 {
+				log.Printf("Warning: ignoring address update without a host address")
+				continue
 			}
 
-			// 检查路由更新
-			checkCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
-			routes, err := conn.Routes(checkCtx)
-			cancel()
-
-			if err == nil && len(routes) > 0 {
-				log.Printf("Checking for route updates, current routes: %d routes", len(routes))
-				// 这里可以添加处理路由变更的逻辑
-				// 目前仅记录，实际应用中可能需要更新路由表
-				for _, route := range routes {
-					log.Printf("Route: Start=%s, End=%s, Proto=%d", route.StartIP, route.EndIP, route.IPProtocol)
-					for _, prefix := range route.Prefixes() {
-						log.Printf("Route Prefix: %s", prefix)
-					}
+			state.mu.Lock()
+			if !slices.Equal(state.prefixes, assignedPrefixes) {
+				log.Printf("Assigned prefix changed from %v to %v on TUN device %s", state.prefixes, assignedPrefixes, state.dev.Name())
+				if err := state.applyAddresses(assignedPrefixes); err != nil {
+					log.Printf("Failed to update TUN device addresses: %v", err)
 				}
 			}
+			state.applySubnets(routedSubnets)
+			state.mu.Unlock()
 		}
-	}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			routes, err := session.ipConn.Routes(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Stopped receiving route updates: %v", err)
+				}
+				return
+			}
+			log.Printf("Received route update: %v", routes)
+
+			state.mu.Lock()
+			state.applyRoutes(routes, session.serverIP)
+			state.mu.Unlock()
+		}
+	}()
+
+	wg.Wait()
 }
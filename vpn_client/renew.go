@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+const (
+	defaultCertRenewBefore = 30 * 24 * time.Hour // 未配置 cert_renew_before_days 时的续期窗口
+	certRenewRetryInterval = time.Hour           // 续期失败后的重试间隔
+)
+
+// clientConfigPath 是加载的配置文件路径，证书内嵌在配置中时续期后改写该文件
+var clientConfigPath string
+
+// clientCert 保存当前使用的客户端证书，续期后新的握手使用新证书
+var clientCert certStore
+
+type certStore struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (s *certStore) Get() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+func (s *certStore) Set(cert *tls.Certificate) {
+	s.mu.Lock()
+	s.cert = cert
+	s.mu.Unlock()
+}
+
+// GetClientCertificate 用作 tls.Config 的回调，每次握手时取当前证书
+func (s *certStore) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.Get(), nil
+}
+
+// certRenewBefore 返回续期窗口，0 表示不自动续期
+func certRenewBefore() time.Duration {
+	switch days := clientConfig.CertRenewBeforeDays; {
+	case days < 0:
+		return 0
+	case days == 0:
+		return defaultCertRenewBefore
+	default:
+		return time.Duration(days) * 24 * time.Hour
+	}
+}
+
+// maintainCertificate 在会话期间跟踪客户端证书的有效期，进入续期窗口后通过隧道申请新证书
+func maintainCertificate(ctx context.Context, session *vpnSession) {
+	renewBefore := certRenewBefore()
+	if renewBefore == 0 {
+		return
+	}
+	for {
+		cert := clientCert.Get()
+		if cert == nil || cert.Leaf == nil {
+			return
+		}
+		wait := time.Until(cert.Leaf.NotAfter.Add(-renewBefore))
+		if wait <= 0 {
+			log.Printf("Client certificate expires at %s, requesting renewal", cert.Leaf.NotAfter.Format(time.RFC3339))
+			err := renewCertificate(ctx, session)
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Warning: certificate renewal failed, retrying in %s: %v", certRenewRetryInterval, err)
+			wait = certRenewRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewCertificate 生成新密钥（默认与当前私钥同类型，配置了 key_type 时改用该算法），提交 CSR 换取新证书
+// 新的证书和私钥先写回配置，成功后才用于后续握手
+func renewCertificate(ctx context.Context, session *vpnSession) error {
+	current := clientCert.Get()
+	keyType := clientConfig.KeyType
+	if keyType == "" {
+		keyType = common.KeyTypeOf(current.Leaf.PublicKey)
+	}
+	key, err := common.GenerateKey(keyType)
+	if err != nil {
+		return err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: current.Leaf.Subject.CommonName},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL("/renew"), bytes.NewReader(csrPEM))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	resp, err := session.h3Conn.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("failed to request certificate renewal: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	keyPEM, err := common.MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	renewed, err := tls.X509KeyPair(body, keyPEM)
+	if err != nil {
+		return fmt.Errorf("server returned an invalid certificate: %w", err)
+	}
+	if !renewed.Leaf.NotAfter.After(current.Leaf.NotAfter) {
+		return fmt.Errorf("renewed certificate does not extend the expiry (%s)", renewed.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if err := saveCertificate(body, keyPEM); err != nil {
+		return fmt.Errorf("failed to save renewed certificate: %w", err)
+	}
+	clientCert.Set(&renewed)
+	log.Printf("Client certificate renewed, valid until %s", renewed.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// saveCertificate 持久化新的证书和私钥：内嵌在配置中（或未配置证书文件）时改写配置文件，否则覆盖 tls_cert/tls_key 指向的文件
+func saveCertificate(certPEM, keyPEM []byte) error {
+	if hasInlineCert() || clientConfig.TLSCert == "" || clientConfig.TLSKey == "" {
+		content, err := os.ReadFile(clientConfigPath)
+		if err != nil {
+			return err
+		}
+		updated, err := replaceTOMLLiteral(content, "cert_pem", certPEM)
+		if err != nil {
+			return err
+		}
+		if updated, err = replaceTOMLLiteral(updated, "key_pem", keyPEM); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(clientConfigPath, updated, 0600); err != nil {
+			return err
+		}
+		clientConfig.CertPEM, clientConfig.KeyPEM = string(certPEM), string(keyPEM)
+		return nil
+	}
+	// 先写私钥再写证书，证书仍是旧的时重新加载会失败而不是静默使用不匹配的组合
+	if err := writeFileAtomic(clientConfig.TLSKey, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(clientConfig.TLSCert, certPEM, 0644)
+}
+
+// replaceTOMLLiteral 替换配置中 key = ”'...”' 形式的多行字面量字符串的值，保留文件其余内容和注释
+func replaceTOMLLiteral(content []byte, key string, value []byte) ([]byte, error) {
+	re := regexp.MustCompile(`(?ms)^(\s*` + regexp.QuoteMeta(key) + `\s*=\s*''')(.*?)'''`)
+	loc := re.FindSubmatchIndex(content)
+	if loc == nil {
+		return nil, fmt.Errorf("%s in %s is not a ''' literal string", key, clientConfigPath)
+	}
+	var buf bytes.Buffer
+	buf.Write(content[:loc[3]])
+	buf.WriteByte('\n')
+	buf.Write(value)
+	buf.WriteString("'''")
+	buf.Write(content[loc[1]:])
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic 先写入同目录下的临时文件再重命名，避免中途失败留下损坏的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 管理员角色，权限依次递增
+const (
+	roleViewer     = "viewer"     // 只读
+	roleOperator   = "operator"   // 管理客户端、用户组和策略
+	roleSuperadmin = "superadmin" // 另外可以修改服务器配置和管理管理员账号
+)
+
+var roleLevels = map[string]int{
+	roleViewer:     1,
+	roleOperator:   2,
+	roleSuperadmin: 3,
+}
+
+// 新密码的最小长度
+const minPasswordLength = 8
+
+var errLastSuperadmin = errors.New("至少需要保留一个超级管理员")
+
+// AdminUser 为一个管理员账号
+type AdminUser struct {
+	Username           string     `json:"username"`
+	Role               string     `json:"role"`
+	MustChangePassword bool       `json:"must_change_password"`
+	TOTPEnabled        bool       `json:"totp_enabled"`
+	CreatedAt          *time.Time `json:"created_at"`
+	LockedUntil        *time.Time `json:"locked_until,omitempty"` // 登录失败次数过多时的锁定截止时间
+}
+
+// hasRole 判断 role 是否具有 need 要求的权限
+func hasRole(role, need string) bool {
+	return roleLevels[role] >= roleLevels[need]
+}
+
+// validateUsername 检查用户名：1-64 个字符，不含空白和控制字符
+func validateUsername(username string) error {
+	if username == "" || len(username) > 64 {
+		return errors.New("用户名长度必须为1-64个字符")
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("用户名不能包含空白字符")
+		}
+	}
+	return nil
+}
+
+// validatePassword 检查新密码强度
+func validatePassword(username, password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("密码长度不能少于8个字符")
+	}
+	if password == "admin" || strings.EqualFold(password, username) {
+		return errors.New("密码不能为默认密码或与用户名相同")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// migrateAdminTable 为旧版本的 admin 表补充角色等列：已有账号都是超级管理员，仍在使用默认密码的 admin 账号需要在登录后修改密码
+func migrateAdminTable(db *sql.DB) {
+	for _, col := range []struct{ name, def string }{
+		{"role", "TEXT"},
+		{"must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+		{"created_at", "DATETIME"},
+		{"totp_secret", "TEXT"},
+		{"totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing(db, "admin", col.name, col.def); err != nil {
+			log.Fatalf("更新admin表失败: %v", err)
+		}
+	}
+	if _, err := db.Exec("UPDATE admin SET role = ? WHERE role IS NULL OR role = ''", roleSuperadmin); err != nil {
+		log.Fatalf("更新admin表失败: %v", err)
+	}
+	var hash string
+	if err := db.QueryRow("SELECT password FROM admin WHERE username = 'admin' AND must_change_password = 0").Scan(&hash); err == nil {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte("admin")) == nil {
+			db.Exec("UPDATE admin SET must_change_password = 1 WHERE username = 'admin'")
+			log.Println("默认管理员 admin 仍在使用默认密码，登录后需要先修改密码")
+		}
+	}
+}
+
+// countOtherSuperadmins 返回除 username 之外的超级管理员数量
+func countOtherSuperadmins(db *sql.DB, username string) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM admin WHERE role = ? AND username != ?", roleSuperadmin, username).Scan(&n)
+	return n, err
+}
+
+// ginRequireRole 要求当前会话的账号具有 role 权限，且已经修改过默认密码
+func ginRequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// API 令牌的权限范围已在 ginRequireAuth 中检查
+		if currentAPIToken(c) != nil {
+			c.Next()
+			return
+		}
+		sess := currentSession(c)
+		if sess.MustChangePassword {
+			c.AbortWithStatusJSON(403, gin.H{"error": "请先修改密码", "password_change_required": true})
+			return
+		}
+		if !hasRole(sess.Role, role) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "权限不足"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 修改当前账号的密码，成功后该账号的其他会话全部失效
+func ginHandleChangePassword(dbPath string, sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		sess := currentSession(c)
+		if !checkAdminLogin(dbPath, sess.Username, req.OldPassword) {
+			c.JSON(400, gin.H{"error": "原密码错误"})
+			return
+		}
+		if req.NewPassword == req.OldPassword {
+			c.JSON(400, gin.H{"error": "新密码不能与原密码相同"})
+			return
+		}
+		if err := validatePassword(sess.Username, req.NewPassword); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := hashPassword(req.NewPassword)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "修改密码失败"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec("UPDATE admin SET password = ?, must_change_password = 0 WHERE username = ?", hash, sess.Username); err != nil {
+			c.JSON(500, gin.H{"error": "修改密码失败"})
+			return
+		}
+		if err := sessions.DeleteUserSessions(sess.Username, sess.ID); err != nil {
+			log.Printf("清除管理员 %s 的其他会话失败: %v", sess.Username, err)
+		}
+		log.Printf("管理员 %s 已修改密码", sess.Username)
+		c.String(200, "ok")
+	}
+}
+
+func ginHandleListAdminUsers(dbPath string, guard *LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		rows, err := db.Query("SELECT username, role, must_change_password, totp_enabled, created_at FROM admin ORDER BY username")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		defer rows.Close()
+		users := []AdminUser{}
+		for rows.Next() {
+			var u AdminUser
+			var createdAt sql.NullTime
+			if err := rows.Scan(&u.Username, &u.Role, &u.MustChangePassword, &u.TOTPEnabled, &createdAt); err != nil {
+				continue
+			}
+			if createdAt.Valid {
+				u.CreatedAt = &createdAt.Time
+			}
+			users = append(users, u)
+		}
+		rows.Close()
+		for i := range users {
+			if until := guard.LockedUntil(db, users[i].Username); !until.IsZero() {
+				users[i].LockedUntil = &until
+			}
+		}
+		c.JSON(200, users)
+	}
+}
+
+// 新建管理员，初始密码由超级管理员设置，首次登录后必须修改
+func ginHandleAddAdminUser(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		if err := validateUsername(req.Username); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := roleLevels[req.Role]; !ok {
+			c.JSON(400, gin.H{"error": "无效的角色"})
+			return
+		}
+		if err := validatePassword(req.Username, req.Password); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "创建失败"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		_, err = db.Exec("INSERT INTO admin(username, password, role, must_change_password, created_at) VALUES (?, ?, ?, 1, ?)",
+			req.Username, hash, req.Role, formatDBTime(time.Now()))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "用户名已存在"})
+			return
+		}
+		log.Printf("管理员 %s 创建了账号 %s (%s)", currentSession(c).Username, req.Username, req.Role)
+		c.String(200, "ok")
+	}
+}
+
+// 修改管理员的角色、重置密码或关闭两步验证（身份验证器丢失时）
+// 重置密码后该账号的会话全部失效，下次登录必须修改密码
+func ginHandleUpdateAdminUser(dbPath string, sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username    string `json:"username"`
+			Role        string `json:"role"`
+			Password    string `json:"password"`
+			DisableTOTP bool   `json:"disable_totp"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" || (req.Role == "" && req.Password == "" && !req.DisableTOTP) {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		var role string
+		if err := db.QueryRow("SELECT role FROM admin WHERE username = ?", req.Username).Scan(&role); err != nil {
+			c.JSON(404, gin.H{"error": "管理员不存在"})
+			return
+		}
+		if req.Role != "" && req.Role != role {
+			if _, ok := roleLevels[req.Role]; !ok {
+				c.JSON(400, gin.H{"error": "无效的角色"})
+				return
+			}
+			if role == roleSuperadmin {
+				if n, err := countOtherSuperadmins(db, req.Username); err != nil || n == 0 {
+					c.JSON(400, gin.H{"error": errLastSuperadmin.Error()})
+					return
+				}
+			}
+			if _, err := db.Exec("UPDATE admin SET role = ? WHERE username = ?", req.Role, req.Username); err != nil {
+				c.JSON(500, gin.H{"error": "更新失败"})
+				return
+			}
+			// 不再是超级管理员时删除其签发的 API 令牌，之后恢复角色也不会让旧令牌重新生效
+			if role == roleSuperadmin {
+				if _, err := db.Exec("DELETE FROM api_tokens WHERE created_by = ?", req.Username); err != nil {
+					log.Printf("删除管理员 %s 的 API 令牌失败: %v", req.Username, err)
+				}
+			}
+		}
+		if req.Password != "" {
+			if err := validatePassword(req.Username, req.Password); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			hash, err := hashPassword(req.Password)
+			if err != nil {
+				c.JSON(500, gin.H{"error": "更新失败"})
+				return
+			}
+			if _, err := db.Exec("UPDATE admin SET password = ?, must_change_password = 1 WHERE username = ?", hash, req.Username); err != nil {
+				c.JSON(500, gin.H{"error": "更新失败"})
+				return
+			}
+			if err := sessions.DeleteUserSessions(req.Username, ""); err != nil {
+				log.Printf("清除管理员 %s 的会话失败: %v", req.Username, err)
+			}
+		}
+		if req.DisableTOTP {
+			if err := disableTOTP(db, req.Username); err != nil {
+				c.JSON(500, gin.H{"error": "更新失败"})
+				return
+			}
+		}
+		log.Printf("管理员 %s 更新了账号 %s", currentSession(c).Username, req.Username)
+		c.String(200, "ok")
+	}
+}
+
+// 删除管理员及其会话，不能删除自己或最后一个超级管理员
+func ginHandleDeleteAdminUser(dbPath string, sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.Query("username")
+		if username == "" {
+			c.JSON(400, gin.H{"error": "缺少username参数"})
+			return
+		}
+		if username == currentSession(c).Username {
+			c.JSON(400, gin.H{"error": "不能删除当前登录的账号"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		var role string
+		if err := db.QueryRow("SELECT role FROM admin WHERE username = ?", username).Scan(&role); err != nil {
+			c.JSON(404, gin.H{"error": "管理员不存在"})
+			return
+		}
+		if role == roleSuperadmin {
+			if n, err := countOtherSuperadmins(db, username); err != nil || n == 0 {
+				c.JSON(400, gin.H{"error": errLastSuperadmin.Error()})
+				return
+			}
+		}
+		if _, err := db.Exec("DELETE FROM admin WHERE username = ?", username); err != nil {
+			c.JSON(500, gin.H{"error": "删除失败"})
+			return
+		}
+		db.Exec("DELETE FROM admin_recovery_codes WHERE username = ?", username)
+		db.Exec("DELETE FROM admin_login_challenges WHERE username = ?", username)
+		// 该账号签发的 API 令牌一并删除，之后以同名重建的账号不会继承这些令牌
+		db.Exec("DELETE FROM api_tokens WHERE created_by = ?", username)
+		if err := sessions.DeleteUserSessions(username, ""); err != nil {
+			log.Printf("清除管理员 %s 的会话失败: %v", username, err)
+		}
+		log.Printf("管理员 %s 删除了账号 %s", currentSession(c).Username, username)
+		c.String(200, "ok")
+	}
+}
@@ -1,20 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"database/sql"
-	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"log"
-	"math/big"
 	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -51,9 +48,6 @@ type ServerConfigDB struct {
 var (
 	globalClientIPMap = make(map[string]netip.Addr)
 	globalIPConnMap   = make(map[netip.Addr]*connectip.Conn)
-	// 会话存储
-	sessionStore = make(map[string]string)
-	sessionMu    sync.Mutex
 )
 
 // 数据库相关函数
@@ -83,6 +77,88 @@ func initDB(dbPath string) {
 	if err != nil {
 		log.Fatalf("创建clients表失败: %v", err)
 	}
+	// 证书序列号、到期时间和指纹，旧数据库补充列后从 cert_pem 回填
+	for _, col := range []struct{ name, def string }{
+		{"cert_serial", "TEXT"},
+		{"cert_not_after", "DATETIME"},
+		{"prev_cert_serial", "TEXT"},
+		{"prev_cert_until", "DATETIME"},
+		{"key_type", "TEXT"},
+		{"cert_fingerprint", "TEXT"},
+		{"prev_cert_fingerprint", "TEXT"},
+	} {
+		if err := addColumnIfMissing(db, "clients", col.name, col.def); err != nil {
+			log.Fatalf("更新clients表失败: %v", err)
+		}
+	}
+	backfillClientCertInfo(db)
+	// 客户端改为在本机生成私钥后，服务器不再保存客户端私钥；清除旧版本签发时留下的私钥
+	if res, err := db.Exec("UPDATE clients SET key_pem = NULL WHERE key_pem IS NOT NULL AND key_pem != ''"); err != nil {
+		log.Fatalf("清除客户端私钥失败: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("已从数据库清除 %d 个客户端私钥", n)
+	}
+	// 管理员会话，只保存会话 ID 的摘要
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS admin_sessions (
+		id_hash TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		csrf_token TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		ip TEXT,
+		user_agent TEXT
+	)`)
+	if err != nil {
+		log.Fatalf("创建admin_sessions表失败: %v", err)
+	}
+	// 两步验证的恢复码和登录第二步的临时凭据，只保存摘要
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+		code_hash TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		created_at DATETIME,
+		used_at DATETIME
+	)`)
+	if err != nil {
+		log.Fatalf("创建admin_recovery_codes表失败: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS admin_login_challenges (
+		token_hash TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		log.Fatalf("创建admin_login_challenges表失败: %v", err)
+	}
+	// 登录成功、失败和锁定记录，用于登录限速和审计
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS admin_login_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		event TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("创建admin_login_events表失败: %v", err)
+	}
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_admin_login_events_username ON admin_login_events(username, created_at)")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_admin_login_events_ip ON admin_login_events(ip, created_at)")
+	// 自动化调用使用的 API 令牌，只保存摘要；scopes 为逗号分隔的权限范围
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		last_used_at DATETIME
+	)`)
+	if err != nil {
+		log.Fatalf("创建api_tokens表失败: %v", err)
+	}
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS server_config (
 		id INTEGER PRIMARY KEY,
 		server_addr TEXT,
@@ -118,16 +194,116 @@ func initDB(dbPath string) {
 	if err != nil {
 		log.Fatalf("创建access_policies表失败: %v", err)
 	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS client_addresses (
+		client_id TEXT PRIMARY KEY,
+		last_ip TEXT,
+		static_ip TEXT
+	)`)
+	if err != nil {
+		log.Fatalf("创建client_addresses表失败: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS client_subnets (
+		client_id TEXT,
+		prefix TEXT,
+		PRIMARY KEY (client_id, prefix)
+	)`)
+	if err != nil {
+		log.Fatalf("创建client_subnets表失败: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS revoked_certs (
+		serial TEXT PRIMARY KEY,
+		client_id TEXT,
+		revoked_at DATETIME,
+		reason TEXT
+	)`)
+	if err != nil {
+		log.Fatalf("创建revoked_certs表失败: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS enrollment_tokens (
+		token_hash TEXT PRIMARY KEY,
+		client_id TEXT,
+		created_at DATETIME,
+		expires_at DATETIME,
+		used_at DATETIME
+	)`)
+	if err != nil {
+		log.Fatalf("创建enrollment_tokens表失败: %v", err)
+	}
+	migrateAdminTable(db)
+	// 没有任何管理员时创建默认的超级管理员，首次登录后必须修改密码
 	var count int
-	db.QueryRow("SELECT COUNT(*) FROM admin WHERE username = 'admin'").Scan(&count)
+	db.QueryRow("SELECT COUNT(*) FROM admin").Scan(&count)
 	if count == 0 {
 		hash, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-		_, err = db.Exec("INSERT INTO admin(username, password) VALUES (?, ?)", "admin", string(hash))
+		_, err = db.Exec("INSERT INTO admin(username, password, role, must_change_password, created_at) VALUES (?, ?, ?, 1, ?)",
+			"admin", string(hash), roleSuperadmin, formatDBTime(time.Now()))
 		if err != nil {
 			log.Fatalf("插入默认管理员失败: %v", err)
 		}
-		log.Println("已初始化默认管理员账号：admin/admin")
+		log.Println("已初始化默认管理员账号：admin/admin，首次登录后需要修改密码")
+	}
+}
+
+// addColumnIfMissing 为旧版本创建的表补充新增的列
+func addColumnIfMissing(db *sql.DB, table, column, def string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	return err
+}
+
+// backfillClientCertInfo 为缺少证书信息的客户端记录解析 cert_pem 并回填序列号、到期时间和指纹
+func backfillClientCertInfo(db *sql.DB) {
+	rows, err := db.Query("SELECT client_id, cert_pem FROM clients WHERE (cert_not_after IS NULL OR cert_fingerprint IS NULL) AND cert_pem IS NOT NULL AND cert_pem != ''")
+	if err != nil {
+		log.Printf("查询客户端证书失败: %v", err)
+		return
+	}
+	certs := make(map[string]*x509.Certificate)
+	for rows.Next() {
+		var clientID, certPEM string
+		if err := rows.Scan(&clientID, &certPEM); err != nil {
+			continue
+		}
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs[clientID] = cert
+		}
+	}
+	rows.Close()
+	for clientID, cert := range certs {
+		_, err := db.Exec("UPDATE clients SET cert_serial = ?, cert_not_after = ?, cert_fingerprint = ? WHERE client_id = ?",
+			serialKey(cert.SerialNumber), formatDBTime(cert.NotAfter), certFingerprint(cert), clientID)
+		if err != nil {
+			log.Printf("回填客户端 %s 的证书信息失败: %v", clientID, err)
+		}
+	}
+}
+
+// formatDBTime 按 SQLite datetime() 的格式保存 UTC 时间，便于在 SQL 中直接比较
+func formatDBTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
 }
 
 func getServerConfigFromDB(dbPath string) (ServerConfigDB, error) {
@@ -162,59 +338,126 @@ func saveServerConfigToDB(dbPath string, cfg ServerConfigDB) error {
 	return err
 }
 
-// 会话/认证相关函数
-func checkAdminLogin(dbPath string, username, password string) bool {
+// 客户端地址（粘性分配/固定 IP）相关函数
+// loadClientAddresses 从数据库恢复每个客户端上次使用的地址和固定地址到地址池
+func loadClientAddresses(dbPath string, ipPool *common.IPPoolSet) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		return false
+		log.Printf("加载客户端地址时打开数据库失败: %v", err)
+		return
 	}
 	defer db.Close()
-	var hash string
-	err = db.QueryRow("SELECT password FROM admin WHERE username = ?", username).Scan(&hash)
+	rows, err := db.Query("SELECT client_id, last_ip, static_ip FROM client_addresses")
 	if err != nil {
-		return false
+		log.Printf("查询客户端地址失败: %v", err)
+		return
 	}
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
-}
-
-func generateSessionID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+	defer rows.Close()
+	loaded := 0
+	for rows.Next() {
+		var clientID string
+		var lastIP, staticIP sql.NullString
+		if err := rows.Scan(&clientID, &lastIP, &staticIP); err != nil {
+			continue
+		}
+		lastIPs, _ := parseAddrList(lastIP.String)
+		for _, ip := range lastIPs {
+			ipPool.Remember(clientID, ip)
+		}
+		if staticIPs, err := parseAddrList(staticIP.String); err == nil && len(staticIPs) > 0 {
+			if err := ipPool.SetStatic(clientID, staticIPs); err != nil {
+				log.Printf("恢复客户端 %s 的固定地址 %s 失败: %v", clientID, staticIP.String, err)
+			}
+		}
+		loaded++
+	}
+	log.Printf("已从数据库恢复 %d 个客户端的地址记录", loaded)
 }
 
-func ginSetSession(c *gin.Context, username string) {
-	sid := generateSessionID()
-	sessionMu.Lock()
-	sessionStore[sid] = username
-	sessionMu.Unlock()
-	c.SetCookie("masque_admin_sid", sid, 3600*24, "/", "", false, true)
+// saveClientLastIP 记录客户端最近一次分配到的地址（双栈时以逗号分隔）
+func saveClientLastIP(dbPath string, clientID string, ips []netip.Addr) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO client_addresses (client_id, last_ip) VALUES (?, ?)
+		ON CONFLICT(client_id) DO UPDATE SET last_ip=excluded.last_ip`, clientID, formatAddrList(ips))
+	return err
 }
 
-func ginCheckSession(c *gin.Context) bool {
-	sid, err := c.Cookie("masque_admin_sid")
+// loadClientSubnets 读取客户端背后的路由子网，无效的记录会被跳过
+func loadClientSubnets(dbPath string, clientID string) ([]netip.Prefix, error) {
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		return false
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT prefix FROM client_subnets WHERE client_id = ? ORDER BY prefix", clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subnets []netip.Prefix
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Printf("Ignoring invalid routed subnet %q of client %s: %v", s, clientID, err)
+			continue
+		}
+		subnets = append(subnets, prefix)
 	}
-	sessionMu.Lock()
-	_, ok := sessionStore[sid]
-	sessionMu.Unlock()
-	return ok
+	return subnets, rows.Err()
 }
 
-func ginRequireAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if !ginCheckSession(c) {
-			c.AbortWithStatusJSON(401, gin.H{"error": "未登录或会话已过期"})
-			return
+// parseAddrList 解析逗号分隔的地址列表，空字符串返回空列表
+func parseAddrList(s string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
 		}
-		c.Next()
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// formatAddrList 将地址列表格式化为逗号分隔的字符串
+func formatAddrList(addrs []netip.Addr) string {
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// 会话/认证相关函数
+func checkAdminLogin(dbPath string, username, password string) bool {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	var hash string
+	err = db.QueryRow("SELECT password FROM admin WHERE username = ?", username).Scan(&hash)
+	if err != nil {
+		return false
 	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
 // Gin API 处理函数
 // 登录
-func ginHandleLogin(dbPath string) gin.HandlerFunc {
+func ginHandleLogin(dbPath string, sessions *SessionStore, guard *LoginGuard) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Username string `json:"username"`
@@ -224,15 +467,63 @@ func ginHandleLogin(dbPath string) gin.HandlerFunc {
 			c.JSON(400, gin.H{"error": "参数错误"})
 			return
 		}
-		if checkAdminLogin(dbPath, req.Username, req.Password) {
-			ginSetSession(c, req.Username)
-			c.JSON(200, gin.H{"success": true})
-		} else {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		unlockIP := guard.lockIP(c.ClientIP())
+		defer unlockIP()
+		unlockUser := guard.lockUser(req.Username)
+		defer unlockUser()
+		// 被限制时不校验密码，避免继续猜测
+		if err := guard.Check(db, req.Username, c.ClientIP()); err != nil {
+			respondLoginBlocked(c, err)
+			return
+		}
+		if !checkAdminLogin(dbPath, req.Username, req.Password) {
+			log.Printf("管理员 %s 登录失败 (来自 %s)", req.Username, c.ClientIP())
+			guard.Record(db, c, req.Username, loginEventFailure)
 			c.JSON(401, gin.H{"error": "用户名或密码错误"})
+			return
 		}
+		enabled, err := totpEnabled(db, req.Username)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		// 启用了两步验证的账号此时还不创建会话，需要凭 challenge 提交验证码到 /login/totp
+		if enabled {
+			challenge, err := createLoginChallenge(db, req.Username)
+			if err != nil {
+				c.JSON(500, gin.H{"error": "登录失败"})
+				return
+			}
+			c.JSON(200, gin.H{"totp_required": true, "challenge": challenge})
+			return
+		}
+		guard.Record(db, c, req.Username, loginEventSuccess)
+		loginSuccessResponse(c, sessions, req.Username)
 	}
 }
 
+// loginSuccessResponse 创建会话并返回登录成功的响应
+func loginSuccessResponse(c *gin.Context, sessions *SessionStore, username string) {
+	sess, err := sessions.Create(c, username)
+	if err != nil {
+		log.Printf("创建会话失败: %v", err)
+		c.JSON(500, gin.H{"error": "创建会话失败"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"success":              true,
+		"role":                 sess.Role,
+		"must_change_password": sess.MustChangePassword,
+		"csrf_token":           sess.csrfToken,
+	})
+}
+
 // 客户端相关
 func ginHandleListClients(dbPath string, clientIPMap map[string]netip.Addr) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -242,7 +533,9 @@ func ginHandleListClients(dbPath string, clientIPMap map[string]netip.Addr) gin.
 			return
 		}
 		defer db.Close()
-		rows, err := db.Query("SELECT client_id, client_name, created_at FROM clients ORDER BY created_at DESC")
+		rows, err := db.Query(`SELECT c.client_id, c.client_name, c.created_at, c.cert_not_after, c.key_type, c.cert_pem IS NOT NULL AND c.cert_pem != '', a.last_ip, a.static_ip
+			FROM clients c LEFT JOIN client_addresses a ON a.client_id = c.client_id
+			ORDER BY c.created_at DESC`)
 		if err != nil {
 			c.JSON(500, gin.H{"error": "查询失败"})
 			return
@@ -251,7 +544,9 @@ func ginHandleListClients(dbPath string, clientIPMap map[string]netip.Addr) gin.
 		var clients []map[string]interface{}
 		for rows.Next() {
 			var clientID, clientName, createdAt string
-			rows.Scan(&clientID, &clientName, &createdAt)
+			var certNotAfter, keyType, lastIP, staticIP sql.NullString
+			var enrolled bool
+			rows.Scan(&clientID, &clientName, &createdAt, &certNotAfter, &keyType, &enrolled, &lastIP, &staticIP)
 			_, online := clientIPMap[clientID]
 
 			// Fetch group IDs for the client
@@ -276,6 +571,13 @@ func ginHandleListClients(dbPath string, clientIPMap map[string]netip.Addr) gin.
 				"created_at":  createdAt,
 				"online":      online,
 				"group_ids":   groupIDs, // New field: array of group IDs
+				"last_ip":     lastIP.String,
+				"static_ip":   staticIP.String,
+				// 证书到期时间，客户端会在到期前自动续期
+				"cert_not_after": certNotAfter.String,
+				// 是否已提交 CSR 完成注册
+				"enrolled": enrolled,
+				"key_type": keyType.String,
 			})
 		}
 		c.JSON(200, clients)
@@ -308,86 +610,19 @@ func ginHandleGenClientV2(dbPath string, serverConfig interface{}) gin.HandlerFu
 			return
 		}
 
-		cfg := serverConfig.(common.ServerConfig)
-		var caCertPEM, caKeyPEM []byte
-		var err error
-		if cfg.CACertPEM != "" && cfg.CAKeyPEM != "" {
-			caCertPEM = []byte(cfg.CACertPEM)
-			caKeyPEM = []byte(cfg.CAKeyPEM)
-		} else {
-			caCertPEM, err = os.ReadFile(cfg.CACertFile)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "CA证书不存在，请先生成CA"})
-				return
-			}
-			caKeyPEM, err = os.ReadFile(cfg.CAKeyFile)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "CA私钥不存在，请先生成CA"})
-				return
-			}
-		}
-		block, _ := pem.Decode(caKeyPEM)
-		if block == nil {
-			c.JSON(500, gin.H{"error": "CA私钥格式错误"})
-			return
-		}
-		var caKey *rsa.PrivateKey
-		if block.Type == "RSA PRIVATE KEY" {
-			caKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "解析CA私钥失败"})
-				return
-			}
-		} else if block.Type == "PRIVATE KEY" {
-			keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "解析PKCS#8 CA私钥失败"})
-				return
-			}
-			var ok bool
-			caKey, ok = keyAny.(*rsa.PrivateKey)
-			if !ok {
-				c.JSON(500, gin.H{"error": "CA私钥不是RSA类型"})
-				return
-			}
-		} else {
-			c.JSON(500, gin.H{"error": "CA私钥格式错误(未知类型)"})
+		keyType := c.DefaultQuery("key_type", common.DefaultKeyType)
+		if !slices.Contains(common.KeyTypes, keyType) {
+			c.JSON(400, gin.H{"error": "不支持的密钥类型"})
 			return
 		}
-		caBlock, _ := pem.Decode(caCertPEM)
-		if caBlock == nil || caBlock.Type != "CERTIFICATE" {
-			c.JSON(500, gin.H{"error": "CA证书格式错误"})
-			return
-		}
-		caCert, err := x509.ParseCertificate(caBlock.Bytes)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "解析CA证书失败"})
-			return
-		}
-		clientPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+
+		// 私钥由客户端自己生成，这里只创建待注册的客户端，证书在客户端提交 CSR 后签发
+		ca, err := loadCA(serverConfig.(common.ServerConfig))
 		if err != nil {
-			c.JSON(500, gin.H{"error": "生成客户端私钥失败"})
+			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
 		clientID := uuid.NewString()
-		clientTemplate := x509.Certificate{
-			SerialNumber: big.NewInt(time.Now().UnixNano()),
-			Subject: pkix.Name{
-				Organization: []string{"MasqueVPN Client"},
-				CommonName:   clientID,
-			},
-			NotBefore:   time.Now(),
-			NotAfter:    time.Now().Add(3 * 365 * 24 * time.Hour),
-			KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		}
-		clientDER, err := x509.CreateCertificate(rand.Reader, &clientTemplate, caCert, &clientPriv.PublicKey, caKey)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "生成客户端证书失败"})
-			return
-		}
-		clientCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER})
-		clientKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientPriv)})
 
 		tmplBytes, err := os.ReadFile("config.client.toml.example")
 		if err != nil {
@@ -399,9 +634,9 @@ func ginHandleGenClientV2(dbPath string, serverConfig interface{}) gin.HandlerFu
 			"server_addr":          c.Query("server_addr"),
 			"server_name":          c.Query("server_name"),
 			"mtu":                  c.Query("mtu"),
-			"ca_pem":               string(caCertPEM),
-			"cert_pem":             string(clientCertPEM),
-			"key_pem":              string(clientKeyPEM),
+			"ca_pem":               string(ca.TrustPEM()),
+			"enroll_url":           c.Query("enroll_url"),
+			"key_type":             keyType,
 			"key_log_file":         c.Query("key_log_file"),
 			"log_level":            c.Query("log_level"),
 			"insecure_skip_verify": c.Query("insecure_skip_verify"),
@@ -416,6 +651,14 @@ func ginHandleGenClientV2(dbPath string, serverConfig interface{}) gin.HandlerFu
 		if repl["mtu"] == "" {
 			repl["mtu"] = "1413"
 		}
+		if repl["enroll_url"] == "" {
+			// 默认使用管理员访问管理界面时的地址
+			scheme := "http"
+			if c.Request.TLS != nil {
+				scheme = "https"
+			}
+			repl["enroll_url"] = scheme + "://" + c.Request.Host + "/api/enroll"
+		}
 		if repl["log_level"] == "" {
 			repl["log_level"] = "info"
 		}
@@ -428,8 +671,9 @@ func ginHandleGenClientV2(dbPath string, serverConfig interface{}) gin.HandlerFu
 		config := tmpl
 
 		// db 已在前面打开和 defer close
-		_, err = db.Exec("INSERT INTO clients(client_id, client_name, cert_pem, key_pem, config, created_at) VALUES (?, ?, ?, ?, ?, datetime('now'))",
-			clientID, clientName, string(clientCertPEM), string(clientKeyPEM), config)
+		// 保存的配置保留注册令牌占位符，下载时再签发令牌
+		_, err = db.Exec("INSERT INTO clients(client_id, client_name, config, key_type, created_at) VALUES (?, ?, ?, ?, datetime('now'))",
+			clientID, clientName, config, keyType)
 		if err != nil {
 			c.JSON(500, gin.H{"error": "写入数据库失败"})
 			return
@@ -438,7 +682,8 @@ func ginHandleGenClientV2(dbPath string, serverConfig interface{}) gin.HandlerFu
 	}
 }
 
-func ginHandleDownloadClient(dbPath string) gin.HandlerFunc {
+// 下载客户端配置：待注册的客户端每次下载都会签发新的一次性注册令牌，之前未使用的令牌作废
+func ginHandleDownloadClient(dbPath string, serverCfg common.ServerConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Query("id")
 		if id == "" {
@@ -452,35 +697,192 @@ func ginHandleDownloadClient(dbPath string) gin.HandlerFunc {
 		}
 		defer db.Close()
 		var config string
-		err = db.QueryRow("SELECT config FROM clients WHERE client_id = ?", id).Scan(&config)
+		var certPEM sql.NullString
+		err = db.QueryRow("SELECT config, cert_pem FROM clients WHERE client_id = ?", id).Scan(&config, &certPEM)
 		if err != nil {
 			c.JSON(404, gin.H{"error": "未找到该客户端"})
 			return
 		}
+		if isPendingConfig(config) {
+			if certPEM.String != "" {
+				c.JSON(409, gin.H{"error": "客户端已完成注册，服务器不保存私钥，如需重新下载配置请先重置注册"})
+				return
+			}
+			token, _, err := createEnrollmentToken(db, id, enrollmentTokenTTL(serverCfg))
+			if err != nil {
+				c.JSON(500, gin.H{"error": "生成注册令牌失败"})
+				return
+			}
+			config = strings.ReplaceAll(config, enrollTokenPlaceholder, token)
+		}
 		c.Header("Content-Type", "text/plain; charset=utf-8")
 		c.Header("Content-Disposition", "attachment; filename=config.client.toml")
 		c.String(200, config)
 	}
 }
 
-func ginHandleDeleteClient(dbPath string, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) gin.HandlerFunc {
+// 客户端注册接口（无需登录）：凭一次性令牌提交 CSR，返回签发的证书
+func ginHandleEnroll(dbPath string, serverCfg common.ServerConfig, revocations *RevocationList, bindings *CertBindings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token"`
+			CSR   string `json:"csr"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" || req.CSR == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		csr, err := parseCSR([]byte(req.CSR))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		clientID, err := lookupEnrollmentToken(db, req.Token)
+		if err != nil {
+			if errors.Is(err, errInvalidEnrollmentToken) {
+				log.Printf("来自 %s 的注册请求使用了无效令牌", c.ClientIP())
+				c.JSON(401, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(500, gin.H{"error": "查询注册令牌失败"})
+			return
+		}
+		// CSR 的密钥类型必须与创建客户端时管理员指定的一致
+		var wantKeyType sql.NullString
+		if err := db.QueryRow("SELECT key_type FROM clients WHERE client_id = ?", clientID).Scan(&wantKeyType); err != nil {
+			c.JSON(401, gin.H{"error": "客户端不存在"})
+			return
+		}
+		keyType, err := csrKeyType(csr, wantKeyType.String)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		ca, err := loadCA(serverCfg)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		cert, certPEM, err := issueClientCert(ca.Cert, ca.Key, clientID, csr.PublicKey, clientCertValidity(serverCfg))
+		if err != nil {
+			c.JSON(500, gin.H{"error": "签发证书失败"})
+			return
+		}
+		// 签发成功后才作废令牌，并发使用同一令牌时只有一个请求能保存证书
+		if err := consumeEnrollmentToken(db, req.Token); err != nil {
+			c.JSON(401, gin.H{"error": errInvalidEnrollmentToken.Error()})
+			return
+		}
+		if err := updateClientCert(dbPath, revocations, bindings, clientID, cert, certPEM, keyType, ""); err != nil {
+			c.JSON(500, gin.H{"error": "写入数据库失败"})
+			return
+		}
+		log.Printf("客户端 %s 已通过 %s 完成注册 (serial: %s)", clientID, c.ClientIP(), serialKey(cert.SerialNumber))
+		// 使用中间 CA 时附带证书链，客户端握手时一并发送
+		c.JSON(200, gin.H{"client_id": clientID, "cert_pem": string(ca.LeafChainPEM(certPEM))})
+	}
+}
+
+// 重置客户端注册：吊销当前证书并断开连接，客户端回到待注册状态，可重新下载带新令牌的配置
+func ginHandleResetEnrollment(dbPath string, revocations *RevocationList, bindings *CertBindings, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Query("id")
 		if id == "" {
 			c.JSON(400, gin.H{"error": "缺少id参数"})
 			return
 		}
-		if ipPoolMu != nil && clientIPMap != nil && ipConnMap != nil {
-			ipPoolMu.Lock()
-			if ip, ok := clientIPMap[id]; ok {
-				if conn, ok2 := ipConnMap[ip]; ok2 {
-					log.Printf("主动断开客户端 %s (IP: %s) 的连接", id, ip)
-					conn.Close()
-					delete(ipConnMap, ip)
-				}
-				delete(clientIPMap, id)
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		var config string
+		var certPEM sql.NullString
+		if err := db.QueryRow("SELECT config, cert_pem FROM clients WHERE client_id = ?", id).Scan(&config, &certPEM); err != nil {
+			c.JSON(404, gin.H{"error": "客户端不存在"})
+			return
+		}
+		if !isPendingConfig(config) {
+			c.JSON(400, gin.H{"error": "旧版本生成的客户端不支持重新注册，请删除后重新创建"})
+			return
+		}
+		if certPEM.String != "" {
+			if err := revokeClientCert(db, revocations, id, "re-enrollment"); err != nil {
+				log.Printf("吊销客户端 %s 的证书失败: %v", id, err)
+				c.JSON(500, gin.H{"error": "吊销证书失败"})
+				return
 			}
-			ipPoolMu.Unlock()
+		}
+		_, err = db.Exec("UPDATE clients SET cert_pem = NULL, key_pem = NULL, cert_serial = NULL, cert_not_after = NULL, cert_fingerprint = NULL, prev_cert_fingerprint = NULL, prev_cert_serial = NULL, prev_cert_until = NULL WHERE client_id = ?", id)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "更新失败"})
+			return
+		}
+		if err := bindings.Refresh(id); err != nil {
+			log.Printf("刷新客户端 %s 的证书绑定失败: %v", id, err)
+		}
+		disconnectClient(id, ipPoolMu, clientIPMap, ipConnMap)
+		c.String(200, "ok")
+	}
+}
+
+// 断开客户端当前的 VPN 连接（如果在线）
+func disconnectClient(id string, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) {
+	if ipPoolMu == nil || clientIPMap == nil || ipConnMap == nil {
+		return
+	}
+	ipPoolMu.Lock()
+	defer ipPoolMu.Unlock()
+	if ip, ok := clientIPMap[id]; ok {
+		if conn, ok2 := ipConnMap[ip]; ok2 {
+			log.Printf("主动断开客户端 %s (IP: %s) 的连接", id, ip)
+			conn.Close()
+			delete(ipConnMap, ip)
+		}
+		delete(clientIPMap, id)
+	}
+}
+
+var errClientNoCert = errors.New("客户端尚未注册，没有可吊销的证书")
+
+// 吊销客户端当前持有的证书，以及续期前仍在宽限期内的上一张证书
+// 客户端不存在时返回 sql.ErrNoRows，尚未注册（没有证书）时返回 errClientNoCert
+// 调用方修改完客户端记录后需要刷新 CertBindings
+func revokeClientCert(db *sql.DB, revocations *RevocationList, id, reason string) error {
+	var certPEM sql.NullString
+	if err := db.QueryRow("SELECT cert_pem FROM clients WHERE client_id = ?", id).Scan(&certPEM); err != nil {
+		return err
+	}
+	if certPEM.String == "" {
+		return errClientNoCert
+	}
+	block, _ := pem.Decode([]byte(certPEM.String))
+	if block == nil {
+		return errors.New("客户端证书格式错误")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := revocations.Revoke(cert, id, reason); err != nil {
+		return err
+	}
+	return retirePrevCert(db, revocations, id, reason)
+}
+
+func ginHandleDeleteClient(dbPath string, revocations *RevocationList, bindings *CertBindings, subnetRoutes *subnetRouteTable, ipPool *common.IPPoolSet, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Query("id")
+		if id == "" {
+			c.JSON(400, gin.H{"error": "缺少id参数"})
+			return
 		}
 		db, err := sql.Open("sqlite3", dbPath)
 		if err != nil {
@@ -488,15 +890,317 @@ func ginHandleDeleteClient(dbPath string, ipPoolMu *sync.Mutex, clientIPMap map[
 			return
 		}
 		defer db.Close()
+		// 删除前先吊销证书，否则持有证书的一方仍可以重新连接
+		// 待注册的客户端没有证书，直接删除
+		if err := revokeClientCert(db, revocations, id, "client deleted"); err != nil && !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, errClientNoCert) {
+			log.Printf("吊销客户端 %s 的证书失败: %v", id, err)
+			c.JSON(500, gin.H{"error": "吊销证书失败"})
+			return
+		}
 		_, err = db.Exec("DELETE FROM clients WHERE client_id = ?", id)
 		if err != nil {
 			c.JSON(500, gin.H{"error": "删除失败"})
 			return
 		}
+		if err := bindings.Refresh(id); err != nil {
+			log.Printf("刷新客户端 %s 的证书绑定失败: %v", id, err)
+		}
+		disconnectClient(id, ipPoolMu, clientIPMap, ipConnMap)
+		if subnetRoutes != nil {
+			subnetRoutes.RemoveClient(id)
+		}
+		_, _ = db.Exec("DELETE FROM client_addresses WHERE client_id = ?", id)
+		_, _ = db.Exec("DELETE FROM client_subnets WHERE client_id = ?", id)
+		if ipPool != nil {
+			ipPool.Forget(id)
+		}
 		c.String(200, "ok")
 	}
 }
 
+// 吊销客户端证书并断开连接，客户端记录保留
+func ginHandleRevokeClient(dbPath string, revocations *RevocationList, bindings *CertBindings, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Query("id")
+		if id == "" {
+			c.JSON(400, gin.H{"error": "缺少id参数"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		reason := c.Query("reason")
+		if reason == "" {
+			reason = "revoked by admin"
+		}
+		if err := revokeClientCert(db, revocations, id, reason); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(404, gin.H{"error": "客户端不存在"})
+				return
+			}
+			if errors.Is(err, errClientNoCert) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("吊销客户端 %s 的证书失败: %v", id, err)
+			c.JSON(500, gin.H{"error": "吊销证书失败"})
+			return
+		}
+		if err := bindings.Refresh(id); err != nil {
+			log.Printf("刷新客户端 %s 的证书绑定失败: %v", id, err)
+		}
+		disconnectClient(id, ipPoolMu, clientIPMap, ipConnMap)
+		c.String(200, "ok")
+	}
+}
+
+func ginHandleListRevokedCerts(revocations *RevocationList) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := revocations.List()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		if list == nil {
+			list = []RevokedCert{}
+		}
+		c.JSON(200, list)
+	}
+}
+
+// 公开的 CRL 下载接口，默认返回 DER，format=pem 时返回 PEM
+func ginHandleCRL(revocations *RevocationList) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		der, err := revocations.CRL()
+		if err != nil {
+			log.Printf("生成CRL失败: %v", err)
+			c.JSON(500, gin.H{"error": "生成CRL失败"})
+			return
+		}
+		if c.Query("format") == "pem" {
+			c.Data(200, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+			return
+		}
+		c.Data(200, "application/pkix-crl", der)
+	}
+}
+
+// 为客户端固定 IP 地址，ip 为空表示取消固定；双栈时每个地址族一个地址，以逗号分隔
+func ginHandleSetClientStaticIP(dbPath string, ipPool *common.IPPoolSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ClientID string `json:"client_id"`
+			IP       string `json:"ip"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.ClientID == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		ips, err := parseAddrList(req.IP)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "ip格式错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM clients WHERE client_id = ?", req.ClientID).Scan(&count); err != nil || count == 0 {
+			c.JSON(404, gin.H{"error": "未找到该客户端"})
+			return
+		}
+		if err := ipPool.SetStatic(req.ClientID, ips); err != nil {
+			c.JSON(400, gin.H{"error": "固定地址失败: " + err.Error()})
+			return
+		}
+		var staticIP interface{}
+		if len(ips) > 0 {
+			staticIP = formatAddrList(ips)
+		}
+		_, err = db.Exec(`INSERT INTO client_addresses (client_id, static_ip) VALUES (?, ?)
+			ON CONFLICT(client_id) DO UPDATE SET static_ip=excluded.static_ip`, req.ClientID, staticIP)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "保存失败"})
+			return
+		}
+		c.String(200, "ok")
+	}
+}
+
+// 客户端路由子网：将整个子网分配给客户端（例如分支机构路由器），服务器把发往该子网的流量转发给客户端
+// 修改在客户端下次连接时生效
+func ginHandleListClientSubnets(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		query := "SELECT client_id, prefix FROM client_subnets"
+		var args []interface{}
+		if id := c.Query("client_id"); id != "" {
+			query += " WHERE client_id = ?"
+			args = append(args, id)
+		}
+		rows, err := db.Query(query+" ORDER BY client_id, prefix", args...)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		defer rows.Close()
+		var list []map[string]interface{}
+		for rows.Next() {
+			var clientID, prefix string
+			rows.Scan(&clientID, &prefix)
+			list = append(list, map[string]interface{}{
+				"client_id": clientID,
+				"prefix":    prefix,
+			})
+		}
+		c.JSON(200, list)
+	}
+}
+
+// 客户端子网的最短前缀长度，避免单个客户端接管大段地址（如 0.0.0.0/1）
+const (
+	minClientSubnetBits4 = 8
+	minClientSubnetBits6 = 16
+)
+
+// ginHandleAddClientSubnet 为客户端添加路由子网，子网不能与地址池、其他客户端子网或 advertise_routes 重叠
+// 覆盖整个地址族的默认路由（全隧道）除外，客户端子网比它更具体
+func ginHandleAddClientSubnet(dbPath string, ipPool *common.IPPoolSet, subnetRoutes *subnetRouteTable, advertised *routeAdvertisement) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ClientID string `json:"client_id"`
+			Prefix   string `json:"prefix"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.ClientID == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		prefix, err := netip.ParsePrefix(req.Prefix)
+		if err != nil || prefix != prefix.Masked() {
+			c.JSON(400, gin.H{"error": "子网格式错误"})
+			return
+		}
+		minBits := minClientSubnetBits4
+		if prefix.Addr().Is6() {
+			minBits = minClientSubnetBits6
+		}
+		if prefix.Bits() < minBits || prefix.IsSingleIP() {
+			c.JSON(400, gin.H{"error": "子网前缀长度无效，至少为 /" + strconv.Itoa(minBits) + " 且不能是单个地址"})
+			return
+		}
+		for _, poolPrefix := range ipPool.Prefixes() {
+			if poolPrefix.Overlaps(prefix) {
+				c.JSON(400, gin.H{"error": "子网与地址池 " + poolPrefix.String() + " 重叠"})
+				return
+			}
+		}
+		for _, route := range advertised.Get() {
+			for _, routePrefix := range route.Prefixes() {
+				if routePrefix.Bits() > 0 && routePrefix.Overlaps(prefix) {
+					c.JSON(400, gin.H{"error": "子网与 advertise_routes 中的 " + routePrefix.String() + " 重叠"})
+					return
+				}
+			}
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM clients WHERE client_id = ?", req.ClientID).Scan(&count); err != nil || count == 0 {
+			c.JSON(404, gin.H{"error": "未找到该客户端"})
+			return
+		}
+		rows, err := db.Query("SELECT client_id, prefix FROM client_subnets")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var owner, existing string
+			if err := rows.Scan(&owner, &existing); err != nil {
+				c.JSON(500, gin.H{"error": "数据库错误"})
+				return
+			}
+			if p, err := netip.ParsePrefix(existing); err == nil && p.Overlaps(prefix) {
+				c.JSON(400, gin.H{"error": "子网与客户端 " + owner + " 的子网 " + existing + " 重叠"})
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		_, err = db.Exec("INSERT INTO client_subnets (client_id, prefix) VALUES (?, ?)", req.ClientID, prefix.String())
+		if err != nil {
+			c.JSON(500, gin.H{"error": "保存失败"})
+			return
+		}
+		// 客户端在线时立即安装路由并下发给客户端
+		if err := subnetRoutes.AddSubnet(req.ClientID, prefix); err != nil {
+			log.Printf("Failed to apply subnet %s to online client %s: %v", prefix, req.ClientID, err)
+			c.JSON(500, gin.H{"error": "子网已保存，但未能应用到在线客户端，客户端重新连接后生效"})
+			return
+		}
+		c.String(200, "ok")
+	}
+}
+
+func ginHandleRemoveClientSubnet(dbPath string, subnetRoutes *subnetRouteTable) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ClientID string `json:"client_id"`
+			Prefix   string `json:"prefix"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.ClientID == "" || req.Prefix == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		prefix, err := netip.ParsePrefix(req.Prefix)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "子网格式错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		_, err = db.Exec("DELETE FROM client_subnets WHERE client_id = ? AND prefix = ?", req.ClientID, prefix.Masked().String())
+		if err != nil {
+			c.JSON(500, gin.H{"error": "删除失败"})
+			return
+		}
+		// 客户端在线时立即删除已安装的路由
+		if subnetRoutes != nil {
+			subnetRoutes.Remove(req.ClientID, prefix.Masked())
+		}
+		c.String(200, "ok")
+	}
+}
+
+// ginHandleListIPPools 返回各地址池的使用情况
+func ginHandleListIPPools(ipPool *common.IPPoolSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, ipPool.Stats())
+	}
+}
+
 // 服务器配置相关
 func ginHandleGetServerConfig(dbPath string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -916,7 +1620,7 @@ func refreshAccessControlForGroup(dbPath string, groupID string, clientIPMap map
 }
 
 // 主启动函数
-func StartAPIServer(ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn, serverCfg common.ServerConfig) {
+func StartAPIServer(ipPool *common.IPPoolSet, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn, subnetRoutes *subnetRouteTable, advertised *routeAdvertisement, revocations *RevocationList, bindings *CertBindings, serverCfg common.ServerConfig) {
 	log.Println("API Server is starting or restarting. Session store is being initialized.")
 	globalClientIPMap = clientIPMap
 	globalIPConnMap = ipConnMap
@@ -929,6 +1633,9 @@ func StartAPIServer(ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipC
 	}
 
 	initDB(dbPath)
+	sessions := NewSessionStore(dbPath, serverCfg.APIServer)
+	guard := NewLoginGuard(dbPath, serverCfg.APIServer)
+	tokens := NewAPITokenStore(dbPath)
 
 	// 初始化服务器配置（如果数据库中不存在）
 	_, err := getServerConfigFromDB(dbPath)
@@ -960,62 +1667,90 @@ func StartAPIServer(ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipC
 	// 初始化 Gin
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+	// 只信任配置的反向代理转发的来源地址和协议，否则任何人都可以伪造 X-Forwarded-For / X-Forwarded-Proto
+	if err := r.SetTrustedProxies(serverCfg.APIServer.TrustedProxies); err != nil {
+		log.Fatalf("trusted_proxies 配置错误: %v", err)
+	}
 
 	// API 路由分组
 	api := r.Group("/api")
 	{
-		api.POST("/login", ginHandleLogin(dbPath))
-		// 新增登出接口
-		api.POST("/logout", func(c *gin.Context) {
-			sid, err := c.Cookie("masque_admin_sid")
-			if err == nil && sid != "" {
-				sessionMu.Lock()
-				delete(sessionStore, sid)
-				sessionMu.Unlock()
-			}
-			// 清除 cookie
-			c.SetCookie("masque_admin_sid", "", -1, "/", "", false, true)
-			c.JSON(http.StatusOK, gin.H{"success": true, "message": "Logged out successfully"})
-		})
+		api.POST("/login", ginHandleLogin(dbPath, sessions, guard))
+		api.POST("/login/totp", ginHandleLoginTOTP(dbPath, sessions, guard))
+		// CRL 需要对外公开，供第三方校验证书状态
+		api.GET("/crl", ginHandleCRL(revocations))
+		// 客户端凭一次性令牌注册，无需登录
+		api.POST("/enroll", ginHandleEnroll(dbPath, serverCfg, revocations, bindings))
+		api.POST("/logout", ginHandleLogout(sessions))
+
+		// 需要认证的接口，修改类请求还需要携带 CSRF 令牌
+		// 以下接口不检查角色，需要修改密码的账号也可以访问
+		auth := api.Group("").Use(ginRequireAuth(sessions, tokens))
+		{
+			auth.GET("/auth/check", ginHandleAuthCheck())
+			auth.POST("/account/password", ginHandleChangePassword(dbPath, sessions))
+			auth.GET("/sessions", ginHandleListSessions(sessions))
+			auth.POST("/sessions/revoke", ginHandleRevokeSession(sessions))
+		}
 
-		// 需要认证的接口
-		auth := api.Group("").Use(ginRequireAuth())
+		// viewer：只读接口
+		viewer := api.Group("").Use(ginRequireAuth(sessions, tokens), ginRequireRole(roleViewer))
 		{
-			// 新增会话检查接口
-			auth.GET("/auth/check", func(c *gin.Context) {
-				sid, _ := c.Cookie("masque_admin_sid") // Cookie由ginRequireAuth保证存在
-				sessionMu.Lock()
-				username, ok := sessionStore[sid]
-				sessionMu.Unlock()
-
-				if ok {
-					c.JSON(http.StatusOK, gin.H{"loggedIn": true, "username": username})
-				} else {
-					// 理论上 ginRequireAuth 会处理未授权，这里作为额外保障
-					c.JSON(http.StatusUnauthorized, gin.H{"loggedIn": false})
-				}
-			})
-			auth.GET("/clients", ginHandleListClients(dbPath, clientIPMap))
-			auth.POST("/gen_client", ginHandleGenClientV2(dbPath, serverCfg)) // 传递 dbPath
-			auth.GET("/download_client", ginHandleDownloadClient(dbPath))
-			auth.POST("/delete_client", ginHandleDeleteClient(dbPath, ipPoolMu, clientIPMap, ipConnMap))
-
-			auth.GET("/server_config", ginHandleGetServerConfig(dbPath))
-			auth.POST("/server_config", ginHandleSetServerConfig(dbPath))
-
-			auth.GET("/groups", ginHandleListGroups(dbPath))
-			auth.POST("/groups", ginHandleAddGroup(dbPath, serverCfg)) // Pass serverCfg
-			auth.POST("/groups/delete", ginHandleDeleteGroup(dbPath))
-			auth.POST("/groups/update", ginHandleUpdateGroup(dbPath))
-
-			auth.GET("/groups/members", ginHandleListGroupMembers(dbPath))
-			auth.POST("/groups/members", ginHandleAddGroupMember(dbPath))
-			auth.POST("/groups/members/remove", ginHandleRemoveGroupMember(dbPath))
-
-			auth.GET("/policies", ginHandleListPolicies(dbPath))
-			auth.POST("/policies", ginHandleAddPolicy(dbPath))
-			auth.POST("/policies/delete", ginHandleDeletePolicy(dbPath))
-			auth.POST("/policies/update", ginHandleUpdatePolicy(dbPath))
+			viewer.GET("/clients", ginHandleListClients(dbPath, clientIPMap))
+			viewer.GET("/revoked_certs", ginHandleListRevokedCerts(revocations))
+			viewer.GET("/ip_pools", ginHandleListIPPools(ipPool))
+			viewer.GET("/clients/subnets", ginHandleListClientSubnets(dbPath))
+			viewer.GET("/server_config", ginHandleGetServerConfig(dbPath))
+			viewer.GET("/groups", ginHandleListGroups(dbPath))
+			viewer.GET("/groups/members", ginHandleListGroupMembers(dbPath))
+			viewer.GET("/policies", ginHandleListPolicies(dbPath))
+
+			// 当前账号的两步验证，所有角色均可设置
+			viewer.GET("/account/totp", ginHandleTOTPStatus(dbPath))
+			viewer.POST("/account/totp/setup", ginHandleTOTPSetup(dbPath))
+			viewer.POST("/account/totp/enable", ginHandleTOTPEnable(dbPath))
+			viewer.POST("/account/totp/disable", ginHandleTOTPDisable(dbPath))
+			viewer.POST("/account/totp/recovery_codes", ginHandleRegenerateRecoveryCodes(dbPath))
+		}
+
+		// operator：管理客户端、用户组和策略；下载的客户端配置包含注册令牌，因此也需要 operator
+		operator := api.Group("").Use(ginRequireAuth(sessions, tokens), ginRequireRole(roleOperator))
+		{
+			operator.POST("/gen_client", ginHandleGenClientV2(dbPath, serverCfg)) // 传递 dbPath
+			operator.GET("/download_client", ginHandleDownloadClient(dbPath, serverCfg))
+			operator.POST("/clients/reenroll", ginHandleResetEnrollment(dbPath, revocations, bindings, ipPoolMu, clientIPMap, ipConnMap))
+			operator.POST("/delete_client", ginHandleDeleteClient(dbPath, revocations, bindings, subnetRoutes, ipPool, ipPoolMu, clientIPMap, ipConnMap))
+			operator.POST("/clients/revoke", ginHandleRevokeClient(dbPath, revocations, bindings, ipPoolMu, clientIPMap, ipConnMap))
+			operator.POST("/clients/static_ip", ginHandleSetClientStaticIP(dbPath, ipPool))
+			operator.POST("/clients/subnets", ginHandleAddClientSubnet(dbPath, ipPool, subnetRoutes, advertised))
+			operator.POST("/clients/subnets/remove", ginHandleRemoveClientSubnet(dbPath, subnetRoutes))
+
+			operator.POST("/groups", ginHandleAddGroup(dbPath, serverCfg)) // Pass serverCfg
+			operator.POST("/groups/delete", ginHandleDeleteGroup(dbPath))
+			operator.POST("/groups/update", ginHandleUpdateGroup(dbPath))
+			operator.POST("/groups/members", ginHandleAddGroupMember(dbPath))
+			operator.POST("/groups/members/remove", ginHandleRemoveGroupMember(dbPath))
+
+			operator.POST("/policies", ginHandleAddPolicy(dbPath))
+			operator.POST("/policies/delete", ginHandleDeletePolicy(dbPath))
+			operator.POST("/policies/update", ginHandleUpdatePolicy(dbPath))
+		}
+
+		// superadmin：服务器配置和管理员账号
+		superadmin := api.Group("").Use(ginRequireAuth(sessions, tokens), ginRequireRole(roleSuperadmin))
+		{
+			superadmin.POST("/server_config", ginHandleSetServerConfig(dbPath))
+
+			superadmin.GET("/admin_users", ginHandleListAdminUsers(dbPath, guard))
+			superadmin.POST("/admin_users", ginHandleAddAdminUser(dbPath))
+			superadmin.POST("/admin_users/update", ginHandleUpdateAdminUser(dbPath, sessions))
+			superadmin.POST("/admin_users/delete", ginHandleDeleteAdminUser(dbPath, sessions))
+			superadmin.GET("/login_events", ginHandleListLoginEvents(dbPath))
+			superadmin.POST("/login_events/unlock", ginHandleUnlockLogin(dbPath, guard))
+
+			superadmin.GET("/api_tokens", ginHandleListAPITokens(tokens))
+			superadmin.POST("/api_tokens", ginHandleCreateAPIToken(tokens))
+			superadmin.POST("/api_tokens/revoke", ginHandleRevokeAPIToken(tokens))
 		}
 	}
 
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// API 令牌的权限范围
+const (
+	scopeClientsRead     = "clients:read"     // 查看客户端、地址池和吊销列表
+	scopeClientsIssue    = "clients:issue"    // 创建客户端和下载配置
+	scopeClientsReenroll = "clients:reenroll" // 重新注册客户端：吊销现有证书并签发新的注册令牌
+	scopePoliciesManage  = "policies:manage"  // 管理用户组和访问策略
+)
+
+var apiTokenScopes = []string{scopeClientsRead, scopeClientsIssue, scopeClientsReenroll, scopePoliciesManage}
+
+// apiTokenRouteScopes 列出 API 令牌可以访问的接口及所需权限，未列出的接口（如管理员账号、令牌管理）只能通过登录会话访问
+var apiTokenRouteScopes = map[string]string{
+	"GET /api/clients":         scopeClientsRead,
+	"GET /api/clients/subnets": scopeClientsRead,
+	"GET /api/revoked_certs":   scopeClientsRead,
+	"GET /api/ip_pools":        scopeClientsRead,
+
+	"POST /api/gen_client":     scopeClientsIssue,
+	"GET /api/download_client": scopeClientsIssue,
+
+	"POST /api/clients/reenroll": scopeClientsReenroll,
+
+	"GET /api/groups":                 scopePoliciesManage,
+	"GET /api/groups/members":         scopePoliciesManage,
+	"POST /api/groups":                scopePoliciesManage,
+	"POST /api/groups/delete":         scopePoliciesManage,
+	"POST /api/groups/update":         scopePoliciesManage,
+	"POST /api/groups/members":        scopePoliciesManage,
+	"POST /api/groups/members/remove": scopePoliciesManage,
+	"GET /api/policies":               scopePoliciesManage,
+	"POST /api/policies":              scopePoliciesManage,
+	"POST /api/policies/delete":       scopePoliciesManage,
+	"POST /api/policies/update":       scopePoliciesManage,
+}
+
+const (
+	// 令牌前缀，便于在日志和代码仓库中识别泄露的令牌
+	apiTokenPrefix = "mvt_"
+	// 令牌有效期上限（天）
+	maxAPITokenDays = 3650
+)
+
+var errInvalidAPIToken = errors.New("API令牌无效或已过期")
+
+// APIToken 为一个用于自动化调用的长期令牌，数据库中只保存令牌的摘要
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"` // 为空表示永不过期
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// allows 判断令牌是否有权访问当前请求的接口
+func (t *APIToken) allows(c *gin.Context) bool {
+	scope, ok := apiTokenRouteScopes[c.Request.Method+" "+c.FullPath()]
+	return ok && slices.Contains(t.Scopes, scope)
+}
+
+// APITokenStore 管理保存在 SQLite 中的 API 令牌
+type APITokenStore struct {
+	dbPath string
+}
+
+func NewAPITokenStore(dbPath string) *APITokenStore {
+	return &APITokenStore{dbPath: dbPath}
+}
+
+// bearerToken 返回 Authorization: Bearer 请求头中的令牌
+func bearerToken(c *gin.Context) (string, bool) {
+	auth := c.GetHeader("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// Create 签发新令牌，返回的明文令牌只在此时可见；days 为 0 表示永不过期
+func (s *APITokenStore) Create(name string, scopes []string, days int, createdBy string) (*APIToken, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := apiTokenPrefix + secret
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	tok := &APIToken{ID: id, Name: name, Scopes: scopes, CreatedBy: createdBy, CreatedAt: now}
+	var expiresAt sql.NullString
+	if days > 0 {
+		exp := now.AddDate(0, 0, days)
+		tok.ExpiresAt = &exp
+		expiresAt = sql.NullString{String: formatDBTime(exp), Valid: true}
+	}
+	_, err = db.Exec("INSERT INTO api_tokens(id, name, token_hash, scopes, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, name, hashToken(raw), strings.Join(scopes, ","), createdBy, formatDBTime(now), expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return tok, raw, nil
+}
+
+// Authenticate 校验令牌并返回其信息，同时刷新最近使用时间
+// 令牌的权限来自签发它的超级管理员，该账号被删除或不再是超级管理员后令牌随之失效
+func (s *APITokenStore) Authenticate(raw string) (*APIToken, error) {
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return nil, errInvalidAPIToken
+	}
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tok, err := scanAPIToken(db.QueryRow(`SELECT t.id, t.name, t.scopes, t.created_by, t.created_at, t.expires_at, t.last_used_at
+		FROM api_tokens t JOIN admin a ON a.username = t.created_by
+		WHERE t.token_hash = ? AND a.role = ?`, hashToken(raw), roleSuperadmin))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if tok.ExpiresAt != nil && !now.Before(*tok.ExpiresAt) {
+		return nil, errInvalidAPIToken
+	}
+	if tok.LastUsedAt == nil || now.Sub(*tok.LastUsedAt) >= sessionTouchInterval {
+		db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", formatDBTime(now), tok.ID)
+	}
+	return tok, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var tok APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&tok.ID, &tok.Name, &scopes, &tok.CreatedBy, &tok.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	tok.Scopes = strings.Split(scopes, ",")
+	if expiresAt.Valid {
+		tok.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		tok.LastUsedAt = &lastUsedAt.Time
+	}
+	return &tok, nil
+}
+
+// List 返回全部令牌（含已过期的），按创建时间倒序
+func (s *APITokenStore) List() ([]APIToken, error) {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT id, name, scopes, created_by, created_at, expires_at, last_used_at FROM api_tokens ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []APIToken{}
+	for rows.Next() {
+		tok, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *tok)
+	}
+	return list, rows.Err()
+}
+
+// Delete 吊销令牌，令牌不存在时返回 sql.ErrNoRows
+func (s *APITokenStore) Delete(id string) error {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	res, err := db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// currentAPIToken 返回 ginRequireAuth 保存的 API 令牌，通过会话认证的请求返回 nil
+func currentAPIToken(c *gin.Context) *APIToken {
+	if v, ok := c.Get("api_token"); ok {
+		return v.(*APIToken)
+	}
+	return nil
+}
+
+func ginHandleListAPITokens(tokens *APITokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := tokens.List()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		c.JSON(200, list)
+	}
+}
+
+// 签发 API 令牌，明文令牌只在响应中返回一次
+func ginHandleCreateAPIToken(tokens *APITokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 64 {
+			c.JSON(400, gin.H{"error": "令牌名称长度必须为1-64个字符"})
+			return
+		}
+		if len(req.Scopes) == 0 {
+			c.JSON(400, gin.H{"error": "至少需要一个权限范围"})
+			return
+		}
+		var scopes []string
+		for _, scope := range req.Scopes {
+			if !slices.Contains(apiTokenScopes, scope) {
+				c.JSON(400, gin.H{"error": "不支持的权限范围: " + scope})
+				return
+			}
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenDays {
+			c.JSON(400, gin.H{"error": "有效期必须为0-3650天，0表示永不过期"})
+			return
+		}
+		username := currentSession(c).Username
+		tok, raw, err := tokens.Create(req.Name, scopes, req.ExpiresInDays, username)
+		if err != nil {
+			log.Printf("签发API令牌失败: %v", err)
+			c.JSON(500, gin.H{"error": "签发令牌失败"})
+			return
+		}
+		log.Printf("管理员 %s 签发了API令牌 %s (%s, 权限: %s)", username, tok.ID, tok.Name, strings.Join(scopes, ","))
+		c.JSON(200, gin.H{"token": raw, "api_token": tok})
+	}
+}
+
+// 吊销 API 令牌，立即生效
+func ginHandleRevokeAPIToken(tokens *APITokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Query("id")
+		if id == "" {
+			c.JSON(400, gin.H{"error": "缺少id参数"})
+			return
+		}
+		if err := tokens.Delete(id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(404, gin.H{"error": "令牌不存在"})
+				return
+			}
+			c.JSON(500, gin.H{"error": "吊销失败"})
+			return
+		}
+		log.Printf("管理员 %s 吊销了API令牌 %s", currentSession(c).Username, id)
+		c.String(200, "ok")
+	}
+}
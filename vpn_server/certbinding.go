@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// CertBindings 缓存每个客户端记录绑定的证书指纹，握手后的授权检查只查内存不访问数据库
+// 只有 CN 与 client_id 一致还不够，证书本身必须是服务器为该客户端签发并记录的那一张
+type CertBindings struct {
+	dbPath string
+
+	mu       sync.RWMutex
+	bindings map[string]certBinding // client_id -> 可接受的证书
+}
+
+// certBinding 为客户端可接受的证书指纹：当前证书，以及续期前的上一张证书
+// 保留上一张证书是为了续期响应丢失时客户端仍能用旧证书连接并再次续期，
+// 客户端用新证书连接或宽限期结束后上一张证书被吊销
+type certBinding struct {
+	current   string
+	prev      string
+	prevUntil time.Time
+}
+
+// certFingerprint 返回证书 DER 编码的 SHA-256 指纹（十六进制）
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewCertBindings 从数据库加载全部客户端的证书指纹
+func NewCertBindings(dbPath string) (*CertBindings, error) {
+	b := &CertBindings{dbPath: dbPath, bindings: make(map[string]certBinding)}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT client_id, cert_fingerprint, prev_cert_fingerprint, prev_cert_until FROM clients")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var clientID string
+		var current, prev sql.NullString
+		var prevUntil sql.NullTime
+		if err := rows.Scan(&clientID, &current, &prev, &prevUntil); err != nil {
+			return nil, err
+		}
+		b.set(clientID, current, prev, prevUntil)
+	}
+	return b, rows.Err()
+}
+
+func (b *CertBindings) set(clientID string, current, prev sql.NullString, prevUntil sql.NullTime) {
+	if current.String == "" && prev.String == "" {
+		delete(b.bindings, clientID)
+		return
+	}
+	b.bindings[clientID] = certBinding{current: current.String, prev: prev.String, prevUntil: prevUntil.Time}
+}
+
+// Authorize 返回证书 CN 中的 client_id，以及该证书是否为此客户端当前绑定的证书
+// 上一张证书只在宽限期内有效
+func (b *CertBindings) Authorize(cert *x509.Certificate) (string, bool) {
+	clientID := cert.Subject.CommonName
+	fp := certFingerprint(cert)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	bound, ok := b.bindings[clientID]
+	if !ok {
+		return clientID, false
+	}
+	if fp == bound.current {
+		return clientID, true
+	}
+	return clientID, fp == bound.prev && time.Now().Before(bound.prevUntil)
+}
+
+// SupersedesPrevious 判断证书是否为客户端的当前证书且还有未吊销的上一张证书
+// 客户端用新证书连接后，上一张证书就不再需要
+func (b *CertBindings) SupersedesPrevious(cert *x509.Certificate) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	bound, ok := b.bindings[cert.Subject.CommonName]
+	return ok && bound.prev != "" && bound.current == certFingerprint(cert)
+}
+
+// Refresh 在修改客户端证书（注册、续期、吊销、重置、删除）后从数据库重新读取该客户端的绑定
+func (b *CertBindings) Refresh(clientID string) error {
+	db, err := sql.Open("sqlite3", b.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var current, prev sql.NullString
+	var prevUntil sql.NullTime
+	err = db.QueryRow("SELECT cert_fingerprint, prev_cert_fingerprint, prev_cert_until FROM clients WHERE client_id = ?", clientID).Scan(&current, &prev, &prevUntil)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && err != sql.ErrNoRows {
+		// 读取失败时宁可拒绝该客户端，也不继续使用可能已失效的绑定
+		delete(b.bindings, clientID)
+		return err
+	}
+	b.set(clientID, current, prev, prevUntil)
+	return nil
+}
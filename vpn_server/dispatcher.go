@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connectip "github.com/iselt/connect-ip-go"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// 分发器默认参数
+const (
+	defaultClientQueueSize = 512 // 每个客户端发送队列的默认长度
+	maxDefaultWorkers      = 4   // 未配置时 worker 数量的上限
+
+	// 读取 TUN 设备连续出错时的等待时间，从最小值开始翻倍，读取成功后重置
+	readErrorBackoffMin = 10 * time.Millisecond
+	readErrorBackoffMax = time.Second
+)
+
+// dispatchPacket 是等待发送给客户端的数据包，buf 来自分发器的缓冲区池
+type dispatchPacket struct {
+	buf []byte
+	n   int
+}
+
+// clientSender 持有单个客户端连接的有界发送队列，该连接的地址和路由子网共用同一个队列
+// 由独立的 goroutine 串行写入 connectip.Conn，慢客户端只会填满自己的队列，不会拖慢其他客户端
+type clientSender struct {
+	clientID string
+	conn     *connectip.Conn
+	queue    chan dispatchPacket
+	done     chan struct{}
+	stopOnce sync.Once
+	dropped  atomic.Uint64
+	refs     int // 指向该队列的前缀数量，由 Dispatcher.mu 保护
+}
+
+// routeTable 是路由表的只读快照
+// 客户端地址（主机前缀）走哈希表；客户端背后的路由子网按前缀长度降序排列，按最长前缀匹配
+type routeTable struct {
+	hosts   map[netip.Addr]*clientSender
+	subnets []subnetRoute
+}
+
+// subnetRoute 是指向客户端的路由子网
+type subnetRoute struct {
+	prefix netip.Prefix
+	sender *clientSender
+}
+
+// lookup 查找目标地址对应的发送队列
+func (rt *routeTable) lookup(dst netip.Addr) (*clientSender, bool) {
+	if sender, ok := rt.hosts[dst]; ok {
+		return sender, true
+	}
+	for _, r := range rt.subnets {
+		if r.prefix.Contains(dst) {
+			return r.sender, true
+		}
+	}
+	return nil, false
+}
+
+// get 返回与 prefix 完全相同的路由
+func (rt *routeTable) get(prefix netip.Prefix) *clientSender {
+	if prefix.IsSingleIP() {
+		return rt.hosts[prefix.Addr()]
+	}
+	for _, r := range rt.subnets {
+		if r.prefix == prefix {
+			return r.sender
+		}
+	}
+	return nil
+}
+
+// with 返回设置了 prefix -> sender 的新路由表，sender 为 nil 表示删除
+func (rt *routeTable) with(prefix netip.Prefix, sender *clientSender) *routeTable {
+	next := &routeTable{
+		hosts:   make(map[netip.Addr]*clientSender, len(rt.hosts)+1),
+		subnets: make([]subnetRoute, 0, len(rt.subnets)+1),
+	}
+	for k, v := range rt.hosts {
+		next.hosts[k] = v
+	}
+	for _, r := range rt.subnets {
+		if r.prefix != prefix {
+			next.subnets = append(next.subnets, r)
+		}
+	}
+	switch {
+	case prefix.IsSingleIP() && sender != nil:
+		next.hosts[prefix.Addr()] = sender
+	case prefix.IsSingleIP():
+		delete(next.hosts, prefix.Addr())
+	case sender != nil:
+		next.subnets = append(next.subnets, subnetRoute{prefix: prefix, sender: sender})
+		slices.SortStableFunc(next.subnets, func(a, b subnetRoute) int { return b.prefix.Bits() - a.prefix.Bits() })
+	}
+	return next
+}
+
+// Dispatcher 负责 TUN->VPN 方向的数据包分发
+// 多个 worker 批量读取 TUN 设备，按目标地址查表后投递到对应客户端的发送队列。
+// 路由表采用 RCU 方式：读路径无锁加载快照，写路径在 mu 下复制整张表后原子替换。
+type Dispatcher struct {
+	dev       *common.TUNDevice
+	workers   int
+	queueSize int
+	isolation bool // 禁止客户端之间互访
+	bufPool   sync.Pool
+
+	mu      sync.Mutex // 串行化路由表的写操作
+	routes  atomic.Pointer[routeTable]
+	senders map[*connectip.Conn]*clientSender // 每个连接一个发送队列，由 mu 保护
+}
+
+// NewDispatcher 创建分发器，workers 或 queueSize 为 0 时使用默认值
+func NewDispatcher(dev *common.TUNDevice, workers, queueSize, mtu int, isolation bool) *Dispatcher {
+	if workers <= 0 {
+		workers = min(runtime.NumCPU(), maxDefaultWorkers)
+	}
+	if queueSize <= 0 {
+		queueSize = defaultClientQueueSize
+	}
+	bufSize := max(common.BufferSize, mtu)
+
+	d := &Dispatcher{
+		dev:       dev,
+		workers:   workers,
+		queueSize: queueSize,
+		isolation: isolation,
+		senders:   make(map[*connectip.Conn]*clientSender),
+	}
+	d.bufPool.New = func() interface{} {
+		return make([]byte, bufSize)
+	}
+	d.routes.Store(&routeTable{hosts: map[netip.Addr]*clientSender{}})
+	return d
+}
+
+// Start 启动所有读取 worker，TUN 设备关闭后 worker 自动退出
+func (d *Dispatcher) Start() {
+	log.Printf("Starting TUN dispatcher with %d workers, client queue size %d, client isolation %v", d.workers, d.queueSize, d.isolation)
+	for i := 0; i < d.workers; i++ {
+		go d.readLoop(i)
+	}
+}
+
+// Register 将前缀路由到指定客户端连接
+// 前缀可以是客户端地址（/32、/128），也可以是客户端背后的路由子网；同一连接的所有前缀共用一个发送队列，
+// 第一次注册时启动发送 goroutine。如果该前缀原先属于其他连接，会从那个连接移除
+func (d *Dispatcher) Register(prefix netip.Prefix, clientID string, conn *connectip.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sender, ok := d.senders[conn]
+	if !ok {
+		sender = &clientSender{
+			clientID: clientID,
+			conn:     conn,
+			queue:    make(chan dispatchPacket, d.queueSize),
+			done:     make(chan struct{}),
+		}
+		d.senders[conn] = sender
+		go d.sendLoop(sender)
+	}
+	old := d.routes.Load()
+	prev := old.get(prefix)
+	if prev == sender {
+		return
+	}
+	sender.refs++
+	d.routes.Store(old.with(prefix, sender))
+	if prev != nil {
+		d.release(prev)
+	}
+}
+
+// Unregister 移除前缀对应的路由，仅当该路由仍属于 conn 时才生效
+func (d *Dispatcher) Unregister(prefix netip.Prefix, conn *connectip.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old := d.routes.Load()
+	sender := old.get(prefix)
+	if sender == nil || sender.conn != conn {
+		return
+	}
+	d.routes.Store(old.with(prefix, nil))
+	d.release(sender)
+}
+
+// release 减少发送队列的引用，最后一个前缀移除后停止发送 goroutine，调用方需持有 d.mu
+func (d *Dispatcher) release(sender *clientSender) {
+	sender.refs--
+	if sender.refs > 0 {
+		return
+	}
+	delete(d.senders, sender.conn)
+	sender.stop()
+	if dropped := sender.dropped.Load(); dropped > 0 {
+		log.Printf("Dispatcher dropped %d packets for client %s due to full queue", dropped, sender.clientID)
+	}
+}
+
+// Hairpin 返回客户端 VPN->TUN 方向的拦截函数
+// 目标属于其他已连接客户端（地址或路由子网）时，直接投递到对方的发送队列，不再经过内核 TUN 绕行；
+// 开启客户端隔离时丢弃这类数据包。数据包仍经过双方连接的 ReadPacket/WritePacket，访问控制策略照常生效。
+func (d *Dispatcher) Hairpin(conn *connectip.Conn) common.PacketInterceptor {
+	return func(packet []byte) bool {
+		dstIP, err := common.GetDestinationIP(packet, len(packet))
+		if err != nil {
+			return false
+		}
+		sender, ok := d.routes.Load().lookup(dstIP)
+		if !ok || sender.conn == conn {
+			return false
+		}
+		if d.isolation {
+			return true
+		}
+		buf := d.bufPool.Get().([]byte)
+		if len(packet) > len(buf) {
+			d.bufPool.Put(buf)
+			return false
+		}
+		n := copy(buf, packet)
+		if !sender.enqueue(dispatchPacket{buf: buf, n: n}) {
+			d.bufPool.Put(buf)
+		}
+		return true
+	}
+}
+
+// readLoop 批量读取 TUN 设备并分发数据包
+func (d *Dispatcher) readLoop(id int) {
+	batchSize := d.dev.BatchSize()
+	if batchSize <= 0 {
+		batchSize = 32 // 默认批量大小
+	}
+
+	bufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	for i := range bufs {
+		bufs[i] = d.bufPool.Get().([]byte)
+	}
+
+	backoff := readErrorBackoffMin
+	for {
+		n, err := d.dev.Read(bufs, sizes, 0)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+				log.Printf("TUN device closed, stopping dispatch worker %d", id)
+				return
+			}
+			// 持续出错时退避，避免空转占满 CPU 和刷屏日志
+			log.Printf("TUN read error in dispatch worker %d, retrying in %v: %v", id, backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, readErrorBackoffMax)
+			continue
+		}
+		backoff = readErrorBackoffMin
+
+		routes := d.routes.Load()
+		for i := 0; i < n; i++ {
+			dstIP, err := common.GetDestinationIP(bufs[i], sizes[i])
+			if err != nil {
+				continue
+			}
+			sender, ok := routes.lookup(dstIP)
+			if !ok {
+				continue
+			}
+			// 入队成功后缓冲区所有权转移给发送 goroutine，这里换上新的缓冲区
+			if sender.enqueue(dispatchPacket{buf: bufs[i], n: sizes[i]}) {
+				bufs[i] = d.bufPool.Get().([]byte)
+			}
+		}
+	}
+}
+
+// sendLoop 将队列中的数据包写入客户端连接
+func (d *Dispatcher) sendLoop(s *clientSender) {
+	for {
+		select {
+		case <-s.done:
+			d.drain(s)
+			return
+		case p := <-s.queue:
+			icmp, err := s.conn.WritePacket(p.buf[:p.n])
+			d.bufPool.Put(p.buf)
+			if err != nil {
+				log.Printf("Failed to forward packet to client %s: %v", s.clientID, err)
+				continue
+			}
+			if len(icmp) > 0 {
+				common.WriteICMPToTun(d.dev, icmp)
+			}
+		}
+	}
+}
+
+// drain 回收队列中剩余的缓冲区
+func (d *Dispatcher) drain(s *clientSender) {
+	for {
+		select {
+		case p := <-s.queue:
+			d.bufPool.Put(p.buf)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue 非阻塞入队，队列已满时丢弃并计数
+func (s *clientSender) enqueue(p dispatchPacket) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	select {
+	case s.queue <- p:
+		return true
+	default:
+		s.dropped.Add(1)
+		return false
+	}
+}
+
+func (s *clientSender) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// 未配置 enrollment_token_ttl_hours 时注册令牌的有效期
+const defaultEnrollmentTokenTTL = 24 * time.Hour
+
+// 客户端配置模板中注册令牌的占位符，保存的配置中保留该占位符，下载时才填入新令牌
+const enrollTokenPlaceholder = "{{enroll_token}}"
+
+var errInvalidEnrollmentToken = errors.New("注册令牌无效、已使用或已过期")
+
+// enrollmentTokenTTL 返回配置的注册令牌有效期
+func enrollmentTokenTTL(cfg common.ServerConfig) time.Duration {
+	if cfg.EnrollmentTokenTTLHours > 0 {
+		return time.Duration(cfg.EnrollmentTokenTTLHours) * time.Hour
+	}
+	return defaultEnrollmentTokenTTL
+}
+
+// hashToken 返回令牌的 SHA-256 摘要，数据库中只保存摘要
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createEnrollmentToken 为待注册的客户端签发新的一次性令牌，同时作废该客户端之前未使用的令牌
+func createEnrollmentToken(db *sql.DB, clientID string, ttl time.Duration) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(ttl)
+	if _, err := db.Exec("DELETE FROM enrollment_tokens WHERE client_id = ? AND used_at IS NULL", clientID); err != nil {
+		return "", time.Time{}, err
+	}
+	_, err := db.Exec("INSERT INTO enrollment_tokens(token_hash, client_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), clientID, formatDBTime(time.Now()), formatDBTime(expiresAt))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// lookupEnrollmentToken 返回有效令牌对应的 client_id，不作废令牌
+func lookupEnrollmentToken(db *sql.DB, token string) (string, error) {
+	var clientID string
+	err := db.QueryRow("SELECT client_id FROM enrollment_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token), formatDBTime(time.Now())).Scan(&clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errInvalidEnrollmentToken
+	}
+	return clientID, err
+}
+
+// consumeEnrollmentToken 作废令牌，并发请求中只有一个能成功
+func consumeEnrollmentToken(db *sql.DB, token string) error {
+	res, err := db.Exec("UPDATE enrollment_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?",
+		formatDBTime(time.Now()), hashToken(token), formatDBTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errInvalidEnrollmentToken
+	}
+	return nil
+}
+
+// parseCSR 解析并校验 PEM 编码的 CSR
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("CSR格式错误")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.New("解析CSR失败")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New("CSR签名无效")
+	}
+	return csr, nil
+}
+
+// isPendingConfig 判断保存的客户端配置是否为等待注册的模板
+func isPendingConfig(config string) bool {
+	return strings.Contains(config, enrollTokenPlaceholder)
+}
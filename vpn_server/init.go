@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// 初始化生成的起始配置
+const starterServerConfig = `# VPN 服务端配置（由 vpn-server init 生成，完整选项见 config.server.toml.example）
+
+# 监听地址和端口
+listen_addr = %q
+
+# mTLS
+cert_file = %q
+key_file = %q
+ca_cert_file = %q
+ca_key_file = %q
+%s
+# VPN 网络 CIDR，第一个 IP 将作为网关
+assign_cidr = %q
+
+# 向客户端通告的路由
+advertise_routes = [%q]
+
+# 日志级别
+log_level = "info"
+
+# 服务器名称（客户端使用它来验证服务器和URI模板），已写入服务器证书的 SAN
+server_name = %q
+
+mtu = 1413
+
+[api_server]
+listen_addr = "0.0.0.0:8080"
+static_dir = "../admin_webui/dist"
+database_path = "masque_admin.db"
+`
+
+// runInit 实现 vpn-server init 子命令：生成 CA、服务器证书和起始配置，替代 cert/ 下的 OpenSSL 脚本
+// 已存在的文件默认不会被覆盖，需要显式指定 -force
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("c", "config.server.toml", "Config file to write")
+	certDir := fs.String("dir", "cert", "Directory for the CA and server certificate, relative to the config file's directory")
+	serverName := fs.String("server-name", "vpn.example.local", "Server name clients connect to, written to the certificate SANs")
+	listenAddr := fs.String("listen", "0.0.0.0:4433", "VPN listen address")
+	cidr := fs.String("cidr", "10.99.0.0/24", "Client address pool")
+	keyType := fs.String("key-type", common.DefaultKeyType, fmt.Sprintf("Key algorithm for the CA and server certificate %v", common.KeyTypes))
+	caDays := fs.Int("ca-days", 3650, "CA certificate lifetime in days")
+	serverDays := fs.Int("server-days", 825, "Server certificate lifetime in days")
+	intermediate := fs.Bool("intermediate", false, "Create an offline root CA and an intermediate CA that issues the server and client certificates")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Parse(args)
+
+	if !slices.Contains(common.KeyTypes, *keyType) {
+		return fmt.Errorf("unsupported key type %q, expected one of %v", *keyType, common.KeyTypes)
+	}
+	if _, err := netip.ParsePrefix(*cidr); err != nil {
+		return fmt.Errorf("invalid cidr %q: %w", *cidr, err)
+	}
+	listenHost, _, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", *listenAddr, err)
+	}
+
+	// 证书写入配置文件所在目录下的 certDir；服务器按工作目录解析配置中的路径，因此配置中写入同样的路径
+	certPath := filepath.Join(filepath.Dir(*configPath), *certDir)
+	files := map[string]string{
+		"ca.crt":     filepath.Join(certPath, "ca.crt"),
+		"ca.key":     filepath.Join(certPath, "ca.key"),
+		"server.crt": filepath.Join(certPath, "server.crt"),
+		"server.key": filepath.Join(certPath, "server.key"),
+	}
+	if *intermediate {
+		files["ca-root.crt"] = filepath.Join(certPath, "ca-root.crt")
+		files["ca-root.key"] = filepath.Join(certPath, "ca-root.key")
+	}
+	if !*force {
+		var existing []string
+		for _, path := range append(sortedValues(files), *configPath) {
+			if _, err := os.Stat(path); err == nil {
+				existing = append(existing, path)
+			}
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("refusing to overwrite existing files %v, use -force to replace them", existing)
+		}
+	}
+
+	// --- CA ---
+	caKey, err := common.GenerateKey(*keyType)
+	if err != nil {
+		return err
+	}
+	caCert, caCertPEM, err := createCA(caKey, "MasqueVPN CA", time.Duration(*caDays)*24*time.Hour)
+	if err != nil {
+		return fmt.Errorf("failed to create CA: %w", err)
+	}
+	caKeyPEM, err := common.MarshalPrivateKeyPEM(caKey)
+	if err != nil {
+		return err
+	}
+	// 使用中间 CA 时，上面生成的是根 CA，ca.crt/ca.key 改为中间 CA，根 CA 只用于签发中间 CA
+	var rootCertPEM, rootKeyPEM []byte
+	if *intermediate {
+		rootCert, rootKey := caCert, caKey
+		rootCertPEM, rootKeyPEM = caCertPEM, caKeyPEM
+		if caKey, err = common.GenerateKey(*keyType); err != nil {
+			return err
+		}
+		caCert, caCertPEM, err = createIntermediateCA(rootCert, rootKey, caKey.Public(), "MasqueVPN Intermediate CA", time.Duration(*caDays)*24*time.Hour)
+		if err != nil {
+			return fmt.Errorf("failed to create intermediate CA: %w", err)
+		}
+		if caKeyPEM, err = common.MarshalPrivateKeyPEM(caKey); err != nil {
+			return err
+		}
+	}
+
+	// --- 服务器证书：SAN 包含 server_name，监听在具体 IP 上时同时包含该 IP ---
+	hosts := []string{*serverName}
+	if ip := net.ParseIP(listenHost); ip != nil && !ip.IsUnspecified() && listenHost != *serverName {
+		hosts = append(hosts, listenHost)
+	}
+	serverKey, err := common.GenerateKey(*keyType)
+	if err != nil {
+		return err
+	}
+	serverCertPEM, err := issueServerCert(caCert, caKey, serverKey.Public(), *serverName, hosts, time.Duration(*serverDays)*24*time.Hour)
+	if err != nil {
+		return fmt.Errorf("failed to issue server certificate: %w", err)
+	}
+	serverKeyPEM, err := common.MarshalPrivateKeyPEM(serverKey)
+	if err != nil {
+		return err
+	}
+	// 服务器证书后附加中间 CA，只信任根 CA 的客户端也能完成校验
+	chainLine := ""
+	if *intermediate {
+		serverCertPEM = append(serverCertPEM, caCertPEM...)
+		chainLine = fmt.Sprintf("ca_chain_file = %q\n", filepath.ToSlash(files["ca-root.crt"]))
+	}
+
+	if err := os.MkdirAll(certPath, 0755); err != nil {
+		return err
+	}
+	slash := filepath.ToSlash
+	config := fmt.Sprintf(starterServerConfig, *listenAddr, slash(files["server.crt"]), slash(files["server.key"]), slash(files["ca.crt"]), slash(files["ca.key"]), chainLine,
+		*cidr, *cidr, *serverName)
+	type outputFile struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}
+	var outputs []outputFile
+	if *intermediate {
+		outputs = append(outputs,
+			outputFile{files["ca-root.key"], rootKeyPEM, 0600},
+			outputFile{files["ca-root.crt"], rootCertPEM, 0644})
+	}
+	outputs = append(outputs, []outputFile{
+		{files["ca.key"], caKeyPEM, 0600},
+		{files["ca.crt"], caCertPEM, 0644},
+		{files["server.key"], serverKeyPEM, 0600},
+		{files["server.crt"], serverCertPEM, 0644},
+		{*configPath, []byte(config), 0600},
+	}...)
+	for _, f := range outputs {
+		if err := writeNewFile(f.path, f.data, f.perm, *force); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s\n", f.path)
+	}
+	fmt.Printf("\nCA and server certificate (%s, SAN %v) created.\n", *keyType, hosts)
+	if *intermediate {
+		fmt.Printf("The server only needs the intermediate CA. Move %s to offline storage; it is needed again only to issue a new intermediate CA.\n", files["ca-root.key"])
+	}
+	fmt.Printf("Review %s, then start the server with: vpn-server -c %s\n", *configPath, *configPath)
+	return nil
+}
+
+// writeNewFile 写入文件，force 为 false 时文件已存在则失败，避免覆盖已有的密钥
+func writeNewFile(path string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("refusing to overwrite %s, use -force to replace it", path)
+		}
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortedValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+	return values
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// 未配置时同一用户名在同一 IP 上、同一 IP 允许的连续失败次数和锁定时长
+	defaultLoginMaxFailures      = 5
+	defaultLoginMaxFailuresPerIP = 20
+	defaultLoginLockout          = 15 * time.Minute
+
+	// 锁定前每次失败后需要等待的时间，从 loginBaseDelay 开始逐次翻倍，最长 loginMaxDelay
+	loginBaseDelay = time.Second
+	loginMaxDelay  = 30 * time.Second
+
+	// 登录事件的保留时间
+	loginEventRetention = 30 * 24 * time.Hour
+)
+
+// 登录事件类型
+const (
+	loginEventSuccess     = "success"
+	loginEventFailure     = "failure"      // 用户名或密码错误
+	loginEventTOTPFailure = "totp_failure" // 两步验证码错误或登录凭据无效
+	loginEventLocked      = "locked"       // 失败次数达到上限，用户名在该 IP 上或整个 IP 被临时锁定
+	loginEventUnlocked    = "unlocked"     // 超级管理员解除锁定
+)
+
+// LoginEvent 为一条登录事件记录
+type LoginEvent struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginGuard 按用户名和来源 IP 限制登录尝试，失败次数在锁定时长内累计：
+//   - 用户名的失败（不论来源）只会让下一次尝试等待更久，不会锁定，避免任何人都能把管理员锁在门外；
+//   - 同一用户名在同一 IP 上失败 maxFailures 次后，锁定该 IP 对这个用户名的登录；
+//   - 同一 IP 失败 maxFailuresPerIP 次后锁定该 IP。
+//
+// 每次失败后需要等待的时间指数增长。用户名的计数在登录成功后清零，IP 的计数只能等待过期或由超级管理员解除
+type LoginGuard struct {
+	dbPath           string
+	maxFailures      int
+	maxFailuresPerIP int
+	lockout          time.Duration
+
+	// 串行处理同一 IP、同一用户名的登录尝试，避免并发请求在失败记录写入前绕过等待时间；
+	// 不同 IP 和用户名的尝试（包括密码校验）可以并行
+	locks keyedMutex
+}
+
+// keyedMutex 按键加锁，没有等待者的键会被清理
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock 锁住 key 并返回解锁函数
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l := k.locks[key]
+	if l == nil {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// lockIP 和 lockUser 串行处理同一来源或同一用户名的登录尝试
+// 同时需要两把锁时必须先锁 IP 再锁用户名，避免死锁
+func (g *LoginGuard) lockIP(ip string) func() {
+	return g.locks.Lock("ip:" + ip)
+}
+
+func (g *LoginGuard) lockUser(username string) func() {
+	return g.locks.Lock("user:" + username)
+}
+
+// NewLoginGuard 按 api_server 配置创建登录保护
+func NewLoginGuard(dbPath string, cfg common.APIServerConfig) *LoginGuard {
+	g := &LoginGuard{
+		dbPath:           dbPath,
+		maxFailures:      defaultLoginMaxFailures,
+		maxFailuresPerIP: defaultLoginMaxFailuresPerIP,
+		lockout:          defaultLoginLockout,
+	}
+	if cfg.LoginMaxFailures > 0 {
+		g.maxFailures = cfg.LoginMaxFailures
+	}
+	if cfg.LoginMaxFailuresPerIP > 0 {
+		g.maxFailuresPerIP = cfg.LoginMaxFailuresPerIP
+	}
+	if cfg.LoginLockoutMinutes > 0 {
+		g.lockout = time.Duration(cfg.LoginLockoutMinutes) * time.Minute
+	}
+	return g
+}
+
+// loginBlock 描述一次被拒绝的登录尝试
+type loginBlock struct {
+	locked     bool
+	retryAfter time.Duration
+}
+
+func (b *loginBlock) Error() string {
+	seconds := int(math.Ceil(b.retryAfter.Seconds()))
+	if b.locked {
+		return fmt.Sprintf("登录失败次数过多，已被临时锁定，请在 %d 分钟后重试", (seconds+59)/60)
+	}
+	return fmt.Sprintf("登录尝试过于频繁，请在 %d 秒后重试", seconds)
+}
+
+// failureState 返回 since 之后满足条件 cond 的失败次数和最近一次失败的时间
+func failureState(db *sql.DB, cond string, args []interface{}, since time.Time) (int, time.Time, error) {
+	var count int
+	var last sql.NullString
+	args = append(slices.Clone(args), loginEventFailure, loginEventTOTPFailure, formatDBTime(since))
+	err := db.QueryRow("SELECT COUNT(*), MAX(created_at) FROM admin_login_events WHERE "+cond+" AND event IN (?, ?) AND created_at > ?",
+		args...).Scan(&count, &last)
+	if err != nil || !last.Valid {
+		return count, time.Time{}, err
+	}
+	lastAt, err := time.Parse("2006-01-02 15:04:05", last.String)
+	return count, lastAt, err
+}
+
+// countSince 返回用户名或 IP 失败计数的起点：锁定时长之前，或最近一次清零事件之后
+func (g *LoginGuard) countSince(db *sql.DB, column, value string, resetEvents []string, now time.Time) (time.Time, error) {
+	since := now.Add(-g.lockout)
+	args := []interface{}{value}
+	for _, e := range resetEvents {
+		args = append(args, e)
+	}
+	var reset sql.NullString
+	err := db.QueryRow("SELECT MAX(created_at) FROM admin_login_events WHERE "+column+" = ? AND event IN (?"+strings.Repeat(", ?", len(resetEvents)-1)+")",
+		args...).Scan(&reset)
+	if err != nil {
+		return since, err
+	}
+	if reset.Valid {
+		resetAt, err := time.Parse("2006-01-02 15:04:05", reset.String)
+		if err != nil {
+			return since, err
+		}
+		if resetAt.After(since) {
+			since = resetAt
+		}
+	}
+	return since, nil
+}
+
+// userFailures 返回用户名在所有来源上累计的失败次数和最近一次失败的时间
+func (g *LoginGuard) userFailures(db *sql.DB, username string, now time.Time) (int, time.Time, error) {
+	since, err := g.countSince(db, "username", username, []string{loginEventSuccess, loginEventUnlocked}, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failureState(db, "username = ?", []interface{}{username}, since)
+}
+
+// pairFailures 返回用户名在该 IP 上累计的失败次数和最近一次失败的时间
+// 用户名登录成功或用户名、IP 任一被解除锁定后清零
+func (g *LoginGuard) pairFailures(db *sql.DB, username, ip string, now time.Time) (int, time.Time, error) {
+	since, err := g.countSince(db, "username", username, []string{loginEventSuccess, loginEventUnlocked}, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	ipSince, err := g.countSince(db, "ip", ip, []string{loginEventUnlocked}, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if ipSince.After(since) {
+		since = ipSince
+	}
+	return failureState(db, "username = ? AND ip = ?", []interface{}{username, ip}, since)
+}
+
+// ipFailures 返回 IP 当前累计的失败次数和最近一次失败的时间
+func (g *LoginGuard) ipFailures(db *sql.DB, ip string, now time.Time) (int, time.Time, error) {
+	since, err := g.countSince(db, "ip", ip, []string{loginEventUnlocked}, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failureState(db, "ip = ?", []interface{}{ip}, since)
+}
+
+// wait 根据失败次数计算还需等待的时间，第二个返回值表示是否已被锁定
+// maxFailures 为 0 时只计算等待时间，不会锁定
+func (g *LoginGuard) wait(count, maxFailures int, last, now time.Time) (time.Duration, bool) {
+	if count == 0 {
+		return 0, false
+	}
+	if maxFailures > 0 && count >= maxFailures {
+		return last.Add(g.lockout).Sub(now), true
+	}
+	delay := loginMaxDelay
+	if count <= 16 {
+		delay = min(loginBaseDelay<<(count-1), loginMaxDelay)
+	}
+	return last.Add(delay).Sub(now), false
+}
+
+// Check 判断是否允许来自 ip 的 username 此时尝试登录，不允许时返回 *loginBlock
+// username 为空时只检查 IP
+func (g *LoginGuard) Check(db *sql.DB, username, ip string) error {
+	now := time.Now()
+	var block loginBlock
+	apply := func(count, maxFailures int, last time.Time) {
+		if d, locked := g.wait(count, maxFailures, last, now); d > block.retryAfter {
+			block.retryAfter = d
+			block.locked = locked
+		}
+	}
+	if username != "" {
+		count, last, err := g.userFailures(db, username, now)
+		if err != nil {
+			return err
+		}
+		apply(count, 0, last)
+		count, last, err = g.pairFailures(db, username, ip, now)
+		if err != nil {
+			return err
+		}
+		apply(count, g.maxFailures, last)
+	}
+	count, last, err := g.ipFailures(db, ip, now)
+	if err != nil {
+		return err
+	}
+	apply(count, g.maxFailuresPerIP, last)
+	if block.retryAfter > 0 {
+		return &block
+	}
+	return nil
+}
+
+// Record 记录一次登录事件；失败次数恰好达到上限时额外记录锁定事件
+func (g *LoginGuard) Record(db *sql.DB, c *gin.Context, username, event string) {
+	now := time.Now()
+	ip := c.ClientIP()
+	g.insertEvent(db, username, ip, c.Request.UserAgent(), event, now)
+	db.Exec("DELETE FROM admin_login_events WHERE created_at <= ?", formatDBTime(now.Add(-loginEventRetention)))
+	if event != loginEventFailure && event != loginEventTOTPFailure {
+		return
+	}
+	if username != "" {
+		if count, _, err := g.pairFailures(db, username, ip, now); err == nil && count == g.maxFailures {
+			log.Printf("管理员用户名 %s 在 %s 上登录失败 %d 次，锁定 %v", username, ip, count, g.lockout)
+			g.insertEvent(db, username, ip, "", loginEventLocked, now)
+		}
+	}
+	if count, _, err := g.ipFailures(db, ip, now); err == nil && count == g.maxFailuresPerIP {
+		log.Printf("来自 %s 的管理员登录失败 %d 次，锁定 %v", ip, count, g.lockout)
+		g.insertEvent(db, "", ip, "", loginEventLocked, now)
+	}
+}
+
+func (g *LoginGuard) insertEvent(db *sql.DB, username, ip, userAgent, event string, now time.Time) {
+	// 用户名和 User-Agent 来自未认证的请求，截断后再保存
+	username = truncateUTF8(username, 64)
+	userAgent = truncateUTF8(userAgent, 256)
+	_, err := db.Exec("INSERT INTO admin_login_events(username, ip, user_agent, event, created_at) VALUES (?, ?, ?, ?, ?)",
+		username, ip, userAgent, event, formatDBTime(now))
+	if err != nil {
+		log.Printf("记录登录事件失败: %v", err)
+	}
+}
+
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// LockedUntil 返回用户名在某个来源 IP 上被锁定到的最晚时间，未锁定时返回零值
+func (g *LoginGuard) LockedUntil(db *sql.DB, username string) time.Time {
+	now := time.Now()
+	rows, err := db.Query("SELECT DISTINCT ip FROM admin_login_events WHERE username = ? AND event IN (?, ?) AND created_at > ?",
+		username, loginEventFailure, loginEventTOTPFailure, formatDBTime(now.Add(-g.lockout)))
+	if err != nil {
+		return time.Time{}
+	}
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if rows.Scan(&ip) == nil {
+			ips = append(ips, ip)
+		}
+	}
+	rows.Close()
+	var until time.Time
+	for _, ip := range ips {
+		count, last, err := g.pairFailures(db, username, ip, now)
+		if err != nil {
+			continue
+		}
+		if d, locked := g.wait(count, g.maxFailures, last, now); locked && d > 0 && now.Add(d).After(until) {
+			until = now.Add(d)
+		}
+	}
+	return until
+}
+
+// respondLoginBlocked 在登录被拒绝时返回 429，其他错误返回 500
+func respondLoginBlocked(c *gin.Context, err error) {
+	if block, ok := err.(*loginBlock); ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(block.retryAfter.Seconds()))))
+		c.JSON(429, gin.H{"error": block.Error(), "locked": block.locked})
+		return
+	}
+	c.JSON(500, gin.H{"error": "查询失败"})
+}
+
+// 查询登录事件，可按用户名、IP 过滤，默认返回最近 100 条
+func ginHandleListLoginEvents(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := 100
+		if s := c.Query("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > 1000 {
+				c.JSON(400, gin.H{"error": "limit 必须为 1-1000"})
+				return
+			}
+			limit = n
+		}
+		username := c.Query("username")
+		ip := c.Query("ip")
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		rows, err := db.Query(`SELECT id, username, ip, user_agent, event, created_at FROM admin_login_events
+			WHERE (? = '' OR username = ?) AND (? = '' OR ip = ?)
+			ORDER BY id DESC LIMIT ?`, username, username, ip, ip, limit)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		defer rows.Close()
+		events := []LoginEvent{}
+		for rows.Next() {
+			var e LoginEvent
+			if err := rows.Scan(&e.ID, &e.Username, &e.IP, &e.UserAgent, &e.Event, &e.CreatedAt); err != nil {
+				continue
+			}
+			events = append(events, e)
+		}
+		c.JSON(200, events)
+	}
+}
+
+// 解除用户名或 IP 的登录锁定，并清零其失败计数
+func ginHandleUnlockLogin(dbPath string, guard *LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			IP       string `json:"ip"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "" && req.IP == "") {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		guard.insertEvent(db, req.Username, req.IP, "", loginEventUnlocked, time.Now())
+		log.Printf("管理员 %s 解除了登录锁定 (用户名: %q, IP: %q)", currentSession(c).Username, req.Username, req.IP)
+		c.String(200, "ok")
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,6 +39,14 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// --- 子命令 ---
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := runInit(os.Args[2:]); err != nil {
+			log.Fatalf("init: %v", err)
+		}
+		return
+	}
+
 	// --- 配置加载 ---
 	configFile := flag.String("c", "config.server.toml", "Config file path")
 	flag.Parse()
@@ -47,125 +56,70 @@ func main() {
 
 	// --- 基础验证 ---
 	if serverConfig.ListenAddr == "" || serverConfig.CertFile == "" || serverConfig.KeyFile == "" ||
-		serverConfig.AssignCIDR == "" || serverConfig.ServerName == "" {
+		len(serverConfig.AssignCIDR) == 0 || serverConfig.ServerName == "" {
 		log.Fatal("Missing required configuration values in config.server.toml")
 	}
-
-	// --- 创建 IP 分配器 ---
-	networkInfo, err := common.NewNetworkInfo(serverConfig.AssignCIDR)
+	if serverConfig.APIServer.DatabasePath == "" {
+		serverConfig.APIServer.DatabasePath = "masque_admin.db" // 与 API 服务器默认值保持一致
+	}
+	initDB(serverConfig.APIServer.DatabasePath)
+	revocations, err := NewRevocationList(serverConfig.APIServer.DatabasePath, serverConfig)
 	if err != nil {
-		log.Fatalf("Failed to create IP allocator: %v", err)
+		log.Fatalf("Failed to load revoked certificates: %v", err)
 	}
-
-	// 新增：创建全局 IP 地址池
-	ipPool := common.NewIPPool(networkInfo.GetPrefix(), networkInfo.GetGateway().Addr())
-	clientIPMap := make(map[string]netip.Addr)        // clientID -> IP
-	ipConnMap := make(map[netip.Addr]*connectip.Conn) // IP -> conn
-	var ipPoolMu sync.Mutex
-
-	// --- 创建 TUN 设备 ---
-	tunDev, err := common.CreateTunDevice(serverConfig.TunName, networkInfo.GetGateway(), serverConfig.MTU)
+	bindings, err := NewCertBindings(serverConfig.APIServer.DatabasePath)
 	if err != nil {
-		log.Fatalf("Failed to create TUN device: %v", err)
+		log.Fatalf("Failed to load client certificate bindings: %v", err)
 	}
-	defer tunDev.Close()
 
-	// 启动TUN->VPN分发goroutine（修正位置）
-	go func() {
-		buf := make([]byte, 2048)
-		for {
-			n, err := tunDev.ReadPacket(buf, 0)
-			if err != nil && err != os.ErrClosed {
-				log.Printf("TUN read error: %v", err)
-				continue
-			}
-			if n == 0 {
-				continue
-			}
-			packet := make([]byte, n)
-			copy(packet, buf[:n])
-
-			// 提取目标IP
-			dstIP, err := common.GetDestinationIP(packet, n)
-			if err != nil {
-				log.Printf("Failed to parse destination IP: %v", err)
-				continue
-			}
-
-			ipPoolMu.Lock()
-			conn, ok := ipConnMap[dstIP]
-			ipPoolMu.Unlock()
-			if ok {
-				_, err := conn.WritePacket(packet)
-				if err != nil {
-					log.Printf("Failed to forward packet to client %s: %v", dstIP, err)
-				}
-			} else {
-				// log.Printf("No client found for destination IP %s", dstIP)
-			}
-		}
-	}()
-
-	log.Printf("Starting VPN Server...")
-	log.Printf("Listen Address: %s", serverConfig.ListenAddr)
-	log.Printf("VPN Network: %s", networkInfo.GetPrefix())
-	log.Printf("Gateway IP: %s", networkInfo.GetGateway())
-	log.Printf("Advertised Routes: %v", serverConfig.AdvertiseRoutes)
-
-	// --- 准备路由信息 ---
-	var routesToAdvertise []connectip.IPRoute
-	for _, routeStr := range serverConfig.AdvertiseRoutes {
-		prefix, err := netip.ParsePrefix(routeStr)
+	// --- 创建 IP 分配器（每个地址族一个网段） ---
+	var networks []*common.NetworkInfo
+	for _, cidr := range serverConfig.AssignCIDR {
+		networkInfo, err := common.NewNetworkInfo(cidr)
 		if err != nil {
-			log.Fatalf("Invalid route in advertise_routes '%s': %v", routeStr, err)
+			log.Fatalf("Failed to create IP allocator: %v", err)
 		}
-		routesToAdvertise = append(routesToAdvertise, connectip.IPRoute{
-			StartIP:    prefix.Addr(),
-			EndIP:      common.LastIP(prefix),
-			IPProtocol: 0, // 0 表示任何协议
-		})
+		networks = append(networks, networkInfo)
 	}
 
-	// --- TLS 配置 ---
-	var cert tls.Certificate
-	if serverConfig.CertPEM != "" && serverConfig.KeyPEM != "" {
-		cert, err = tls.X509KeyPair([]byte(serverConfig.CertPEM), []byte(serverConfig.KeyPEM))
-		if err != nil {
-			log.Fatalf("Failed to load TLS certificate/key from config PEM: %v", err)
-		}
-		log.Printf("Loaded TLS certificate/key from config PEM")
-	} else {
-		cert, err = tls.LoadX509KeyPair(serverConfig.CertFile, serverConfig.KeyFile)
-		if err != nil {
-			log.Fatalf("Failed to load TLS certificate/key: %v", err)
-		}
-		log.Printf("Loaded TLS certificate/key from file: %s, %s", serverConfig.CertFile, serverConfig.KeyFile)
+	// 新增：创建全局 IP 地址池
+	ipPool, err := buildIPPools(networks, serverConfig)
+	if err != nil {
+		log.Fatalf("Failed to create IP pool: %v", err)
 	}
+	clientIPMap := make(map[string]netip.Addr)        // clientID -> 主地址（第一个地址族的 IP）
+	ipConnMap := make(map[netip.Addr]*connectip.Conn) // IP -> conn（包含客户端的所有地址）
+	var ipPoolMu sync.Mutex
+	// 恢复粘性分配和固定地址
+	loadClientAddresses(serverConfig.APIServer.DatabasePath, ipPool)
 
-	// 加载CA证书
-	caCertPool := x509.NewCertPool()
-	var caCert []byte
-	if serverConfig.CACertPEM != "" {
-		caCert = []byte(serverConfig.CACertPEM)
-		log.Printf("Loaded CA cert from config PEM")
-	} else {
-		if serverConfig.CACertFile == "" {
-			log.Fatal("ca_file is required for mutual TLS authentication")
-		}
-		caCert, err = os.ReadFile(serverConfig.CACertFile)
-		if err != nil {
-			log.Fatalf("Failed to read CA file %s: %v", serverConfig.CACertFile, err)
-		}
-		log.Printf("Loaded CA cert from file: %s", serverConfig.CACertFile)
+	// 在创建 TUN 设备和 NAT 规则之前检查其余配置并开始监听，之后的 log.Fatal 会跳过清理
+	if _, err := serverConfig.DNS.ServerAddrs(); err != nil {
+		log.Fatalf("Invalid [dns] configuration: %v", err)
+	}
+	if _, err := parseTrustedProxies(serverConfig.APIServer.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies: %v", err)
 	}
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		log.Fatalf("Failed to append CA cert")
+
+	// --- 准备路由信息 ---
+	initialRoutes, err := parseAdvertiseRoutes(serverConfig.AdvertiseRoutes)
+	if err != nil {
+		log.Fatal(err)
 	}
+	routesToAdvertise := &routeAdvertisement{routes: initialRoutes}
 
+	// --- TLS 配置 ---
+	// 服务器证书和 CA 文件变化后自动重新加载，只影响新的握手
+	tlsReloader, err := newTLSReloader(serverConfig, &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		// 每次握手都检查客户端证书是否已被吊销
+		VerifyConnection: revocations.VerifyConnection,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load TLS configuration: %v", err)
+	}
 	tlsConfig := http3.ConfigureTLSConfig(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    caCertPool,
+		GetConfigForClient: tlsReloader.GetConfigForClient,
 	})
 
 	// --- QUIC 配置 ---
@@ -195,6 +149,53 @@ func main() {
 	defer ln.Close()
 	log.Printf("QUIC Listener started on %s", udpConn.LocalAddr())
 
+	// --- 创建 TUN 设备 ---
+	tunDev, err := common.CreateTunDevice(serverConfig.TunName, networks[0].GetGateway(), serverConfig.MTU)
+	if err != nil {
+		log.Fatalf("Failed to create TUN device: %v", err)
+	}
+	defer tunDev.Close()
+	for _, networkInfo := range networks[1:] {
+		if err := tunDev.AddAddress(networkInfo.GetGateway()); err != nil {
+			tunDev.Close()
+			log.Fatalf("Failed to configure TUN device: %v", err)
+		}
+	}
+
+	// 可选：为 VPN 网段安装出口 NAT 规则
+	if serverConfig.NATEgressInterface != "" {
+		var cidrs []netip.Prefix
+		for _, networkInfo := range networks {
+			cidrs = append(cidrs, networkInfo.GetPrefix())
+		}
+		cleanupNAT, err := setupNAT(serverConfig.NATEgressInterface, tunDev.Name(), cidrs)
+		if err != nil {
+			log.Fatalf("Failed to set up NAT: %v", err)
+		}
+		defer cleanupNAT()
+	}
+
+	// 启动TUN->VPN分发器（批量读取 + 无锁路由表 + 每客户端发送队列）
+	dispatcher := NewDispatcher(tunDev, serverConfig.DispatchWorkers, serverConfig.ClientQueueSize, serverConfig.MTU, serverConfig.ClientIsolation)
+	subnetRoutes := newSubnetRouteTable(tunDev, dispatcher)
+	// 退出时先逐条删除客户端子网路由，再关闭设备
+	defer subnetRoutes.Close()
+	dispatcher.Start()
+
+	log.Printf("Starting VPN Server...")
+	log.Printf("Listen Address: %s", serverConfig.ListenAddr)
+	for _, networkInfo := range networks {
+		log.Printf("VPN Network: %s", networkInfo.GetPrefix())
+		log.Printf("Gateway IP: %s", networkInfo.GetGateway())
+	}
+	for _, stats := range ipPool.Stats() {
+		log.Printf("IP Pool %s: capacity %d, reserved %d, static %d", stats.Prefix, stats.Capacity, stats.Reserved, stats.Static)
+	}
+	log.Printf("Advertised Routes: %v", serverConfig.AdvertiseRoutes)
+	if !serverConfig.DNS.IsEmpty() {
+		log.Printf("DNS Servers: %v, search domains: %v, route all: %v", serverConfig.DNS.Servers, serverConfig.DNS.SearchDomains, serverConfig.DNS.RouteAll)
+	}
+
 	// --- CONNECT-IP 代理和 HTTP 处理程序 ---
 	p := connectip.Proxy{}
 	// 使用配置的服务器名称和端口作为模板
@@ -208,35 +209,21 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/vpn", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Incoming VPN request from %s", r.RemoteAddr)
-		// 新增：提取 client_id（证书 CommonName）
-		var clientID string
-		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
-			clientID = r.TLS.PeerCertificates[0].Subject.CommonName
-		} else {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
 			http.Error(w, "未检测到客户端证书", http.StatusUnauthorized)
 			return
 		}
-		// 新增：校验 client_id 是否在数据库中
-		clientIDExists := func(id string) bool {
-			db, err := sql.Open("sqlite3", serverConfig.APIServer.DatabasePath) // 使用配置的数据库路径
-			if err != nil {
-				log.Printf("Error opening database: %v", err) // Log the error
-				return false
-			}
-			defer db.Close()
-			var count int
-			err = db.QueryRow("SELECT COUNT(*) FROM clients WHERE client_id = ?", id).Scan(&count)
-			if err != nil {
-				log.Printf("Error querying database for client_id %s: %v", id, err) // Log the error
-				return false
-			}
-			return count > 0
-		}
-		if !clientIDExists(clientID) {
-			log.Printf("拒绝未知 client_id 连接: %s", clientID)
+		// client_id 取自证书 CommonName，且证书必须是该客户端记录绑定的证书
+		clientID, ok := bindings.Authorize(r.TLS.PeerCertificates[0])
+		if !ok {
+			log.Printf("拒绝未授权的客户端证书: client_id %s, 指纹 %s", clientID, certFingerprint(r.TLS.PeerCertificates[0]))
 			http.Error(w, "客户端未授权或已被删除", http.StatusUnauthorized)
 			return
 		}
+		// 客户端已经用续期后的新证书连接，上一张证书不再需要
+		if bindings.SupersedesPrevious(r.TLS.PeerCertificates[0]) {
+			confirmCurrentCert(serverConfig.APIServer.DatabasePath, revocations, bindings, clientID)
+		}
 
 		req, err := connectip.ParseRequest(r, template)
 		if err != nil {
@@ -254,28 +241,71 @@ func main() {
 
 		log.Printf("CONNECT-IP session established for %s", clientID)
 
-		// 新增：为客户端分配唯一 IP
+		// 新增：为客户端分配唯一 IP（每个地址族一个）
 		ipPoolMu.Lock()
-		assignedPrefix, allocErr := ipPool.Allocate(clientID)
+		assignedPrefixes, allocErr := ipPool.Allocate(clientID)
 		if allocErr != nil {
 			ipPoolMu.Unlock()
 			log.Printf("No available IP for client %s: %v", clientID, allocErr)
 			conn.Close()
 			return
 		}
-		clientIPMap[clientID] = assignedPrefix.Addr()
-		ipConnMap[assignedPrefix.Addr()] = conn
+		assignedAddrs := make([]netip.Addr, 0, len(assignedPrefixes))
+		for _, prefix := range assignedPrefixes {
+			addr := prefix.Addr()
+			// 同一客户端重连时可能复用仍被旧连接持有的地址，此时关闭旧连接
+			if oldConn, ok := ipConnMap[addr]; ok && oldConn != conn {
+				log.Printf("Client %s reconnected, closing previous session on %s", clientID, addr)
+				oldConn.Close()
+			}
+			ipConnMap[addr] = conn
+			assignedAddrs = append(assignedAddrs, addr)
+		}
+		clientIPMap[clientID] = assignedAddrs[0]
 		ipPoolMu.Unlock()
-		log.Printf("Allocated IP %s to client %s", assignedPrefix, clientID)
+		for _, prefix := range assignedPrefixes {
+			dispatcher.Register(prefix, clientID, conn)
+		}
+		log.Printf("Allocated IP %v to client %s", assignedPrefixes, clientID)
+		if err := saveClientLastIP(serverConfig.APIServer.DatabasePath, clientID, assignedAddrs); err != nil {
+			log.Printf("Failed to persist IP %v for client %s: %v", assignedAddrs, clientID, err)
+		}
+
+		// 客户端背后的路由子网：内核路由指向 TUN 设备，分发器按最长前缀匹配转发给该客户端
+		routedSubnets, err := loadClientSubnets(serverConfig.APIServer.DatabasePath, clientID)
+		if err != nil {
+			log.Printf("Failed to load routed subnets for client %s: %v", clientID, err)
+		}
+		subnetRoutes.Attach(clientID, conn, assignedPrefixes, routedSubnets)
+		if len(routedSubnets) > 0 {
+			log.Printf("Routing subnets %v to client %s", routedSubnets, clientID)
+		}
 
 		// 处理客户端连接，传递分配的 IP 和数据库路径
-		go handleClientConnection(conn, clientID, tunDev, assignedPrefix, routesToAdvertise, ipPool, &ipPoolMu, clientIPMap, ipConnMap, serverConfig.APIServer.DatabasePath)
+		go handleClientConnection(conn, clientID, tunDev, dispatcher, subnetRoutes, assignedPrefixes, routedSubnets, routesToAdvertise.Get(), ipPool, &ipPoolMu, clientIPMap, ipConnMap, serverConfig.APIServer.DatabasePath)
+	})
+
+	// DNS 配置：客户端建立 CONNECT-IP 会话后通过同一 HTTP/3 连接获取
+	mux.HandleFunc("/dns", func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "未检测到客户端证书", http.StatusUnauthorized)
+			return
+		}
+		if _, ok := bindings.Authorize(r.TLS.PeerCertificates[0]); !ok {
+			http.Error(w, "客户端未授权或已被删除", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(serverConfig.DNS)
 	})
 
+	// 客户端证书续期接口，只能通过 mTLS 隧道访问
+	mux.HandleFunc("/renew", handleCertRenewal(serverConfig, revocations, bindings))
+
 	// 新增：API服务goroutine
 	go func() {
 		// 传递 serverConfig 给 API Server，并传递监听地址
-		StartAPIServer(&ipPoolMu, clientIPMap, ipConnMap, serverConfig)
+		StartAPIServer(ipPool, &ipPoolMu, clientIPMap, ipConnMap, subnetRoutes, routesToAdvertise, revocations, bindings, serverConfig)
 	}()
 
 	// --- HTTP/3 Server ---
@@ -300,6 +330,22 @@ func main() {
 		log.Println("HTTP/3 server stopped.")
 	}()
 
+	go tlsReloader.Watch(ctx)
+	go watchPrevCerts(ctx, serverConfig.APIServer.DatabasePath, revocations, bindings)
+
+	// SIGHUP：重新读取配置文件中的 advertise_routes，并推送给所有已连接的客户端；同时立即重新加载证书
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			reloadAdvertiseRoutes(*configFile, routesToAdvertise, &ipPoolMu, ipConnMap)
+			if err := tlsReloader.Reload(); err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
+			}
+		}
+	}()
+
 	// 等待关闭信号
 	<-ctx.Done()
 	log.Println("Shutdown signal received...")
@@ -321,35 +367,34 @@ func main() {
 
 // handleClientConnection 处理客户端VPN连接
 func handleClientConnection(conn *connectip.Conn, clientID string,
-	tunDev *common.TUNDevice, assignedPrefix netip.Prefix, routes []connectip.IPRoute,
-	ipPool *common.IPPool, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn, dbPath string) { // 新增 dbPath 参数
+	tunDev *common.TUNDevice, dispatcher *Dispatcher, subnetRoutes *subnetRouteTable, assignedPrefixes, routedSubnets []netip.Prefix, routes []connectip.IPRoute,
+	ipPool *common.IPPoolSet, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn, dbPath string) { // 新增 dbPath 参数
 	defer conn.Close()
+	// 连接结束时从分发路由表中移除，避免继续向已关闭的连接排队；该连接安装的子网路由一并删除
+	defer func() {
+		for _, prefix := range assignedPrefixes {
+			dispatcher.Unregister(prefix, conn)
+		}
+		subnetRoutes.Release(conn)
+	}()
 
 	log.Printf("Handling connection for client %s", clientID)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// --- 为客户端分配唯一 IP 前缀 ---
-	if err := conn.AssignAddresses(ctx, []netip.Prefix{assignedPrefix}); err != nil {
-		log.Printf("Error assigning address %s to client %s: %v", assignedPrefix, clientID, err)
+	// --- 为客户端分配唯一 IP 前缀（每个地址族一个）以及其背后的路由子网 ---
+	if err := conn.AssignAddresses(ctx, slices.Concat(assignedPrefixes, routedSubnets)); err != nil {
+		log.Printf("Error assigning address %v to client %s: %v", assignedPrefixes, clientID, err)
 		// 释放 IP
-		ipPoolMu.Lock()
-		ipPool.Release(assignedPrefix.Addr())
-		delete(clientIPMap, clientID)
-		delete(ipConnMap, assignedPrefix.Addr())
-		ipPoolMu.Unlock()
+		releaseClientAddresses(conn, clientID, assignedPrefixes, ipPool, ipPoolMu, clientIPMap, ipConnMap)
 		return
 	}
-	log.Printf("Assigned IP %s to client %s", assignedPrefix, clientID)
+	log.Printf("Assigned IP %v to client %s", assignedPrefixes, clientID)
 
 	// --- 向客户端广播路由 ---
 	if err := conn.AdvertiseRoute(ctx, routes); err != nil {
 		log.Printf("Error advertising routes to client %s: %v", clientID, err)
-		ipPoolMu.Lock()
-		ipPool.Release(assignedPrefix.Addr())
-		delete(clientIPMap, clientID)
-		delete(ipConnMap, assignedPrefix.Addr())
-		ipPoolMu.Unlock()
+		releaseClientAddresses(conn, clientID, assignedPrefixes, ipPool, ipPoolMu, clientIPMap, ipConnMap)
 		return
 	}
 	log.Printf("Advertised %d routes to client %s", len(routes), clientID)
@@ -366,7 +411,7 @@ func handleClientConnection(conn *connectip.Conn, clientID string,
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		common.ProxyFromVPNToTun(tunDev, conn, errChan)
+		common.ProxyFromVPNToTunWithInterceptor(tunDev, conn, dispatcher.Hairpin(conn), errChan)
 	}()
 
 	err := <-errChan
@@ -377,14 +422,295 @@ func handleClientConnection(conn *connectip.Conn, clientID string,
 	log.Printf("Finished handling client %s", clientID)
 
 	// 连接结束时释放 IP
+	releaseClientAddresses(conn, clientID, assignedPrefixes, ipPool, ipPoolMu, clientIPMap, ipConnMap)
+}
+
+// routeAdvertisement 保存当前向客户端通告的路由，可在运行时更新
+type routeAdvertisement struct {
+	mu     sync.RWMutex
+	routes []connectip.IPRoute
+}
+
+func (a *routeAdvertisement) Get() []connectip.IPRoute {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.routes
+}
+
+// Set 更新路由，返回路由是否发生变化
+func (a *routeAdvertisement) Set(routes []connectip.IPRoute) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if slices.Equal(a.routes, routes) {
+		return false
+	}
+	a.routes = routes
+	return true
+}
+
+// subnetRouteTable 记录已安装到 TUN 设备的客户端子网路由及安装它的连接
+// 客户端重连时路由归新连接所有，旧连接结束时不会删除仍在使用的路由
+type subnetRouteTable struct {
+	tunDev     *common.TUNDevice
+	dispatcher *Dispatcher
+
+	mu     sync.Mutex
+	routes map[netip.Prefix]installedRoute
+	// 在线客户端当前的连接和分配的前缀，管理员增删子网时据此立即生效
+	sessions map[string]*subnetSession
+}
+
+type installedRoute struct {
+	clientID string
+	conn     *connectip.Conn
+}
+
+type subnetSession struct {
+	conn     *connectip.Conn
+	assigned []netip.Prefix
+	subnets  []netip.Prefix
+}
+
+func newSubnetRouteTable(tunDev *common.TUNDevice, dispatcher *Dispatcher) *subnetRouteTable {
+	return &subnetRouteTable{
+		tunDev:     tunDev,
+		dispatcher: dispatcher,
+		routes:     make(map[netip.Prefix]installedRoute),
+		sessions:   make(map[string]*subnetSession),
+	}
+}
+
+// Attach 在客户端连接建立后安装其子网路由并交给分发器，assigned 为分配给客户端的地址前缀
+func (t *subnetRouteTable) Attach(clientID string, conn *connectip.Conn, assigned, subnets []netip.Prefix) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[clientID] = &subnetSession{conn: conn, assigned: assigned, subnets: subnets}
+	for _, subnet := range subnets {
+		if err := t.add(subnet, clientID, conn); err != nil {
+			log.Printf("Failed to add route for subnet %s of client %s: %v", subnet, clientID, err)
+		}
+		t.dispatcher.Register(subnet, clientID, conn)
+	}
+}
+
+// add 安装子网路由，路由已存在时只更新所属连接，调用方需持有 t.mu
+func (t *subnetRouteTable) add(subnet netip.Prefix, clientID string, conn *connectip.Conn) error {
+	if _, ok := t.routes[subnet]; !ok {
+		if err := t.tunDev.AddRoute(subnet); err != nil {
+			return err
+		}
+	}
+	t.routes[subnet] = installedRoute{clientID: clientID, conn: conn}
+	return nil
+}
+
+// remove 删除路由，调用方需持有 t.mu
+func (t *subnetRouteTable) remove(subnet netip.Prefix) {
+	if err := t.tunDev.RemoveRoute(subnet); err != nil {
+		log.Printf("Warning: failed to remove route for subnet %s: %v", subnet, err)
+	}
+	delete(t.routes, subnet)
+}
+
+// Release 在连接结束时删除该连接安装的路由
+func (t *subnetRouteTable) Release(conn *connectip.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for subnet, route := range t.routes {
+		if route.conn == conn {
+			t.dispatcher.Unregister(subnet, conn)
+			t.remove(subnet)
+		}
+	}
+	for clientID, s := range t.sessions {
+		if s.conn == conn {
+			delete(t.sessions, clientID)
+		}
+	}
+}
+
+// AddSubnet 在管理员为客户端添加子网后立即生效：客户端在线时安装路由、交给分发器并重新下发地址分配
+// 客户端离线时什么也不做，下次连接时从数据库加载
+func (t *subnetRouteTable) AddSubnet(clientID string, subnet netip.Prefix) error {
+	t.mu.Lock()
+	s, ok := t.sessions[clientID]
+	if !ok {
+		t.mu.Unlock()
+		return nil
+	}
+	if err := t.add(subnet, clientID, s.conn); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	t.dispatcher.Register(subnet, clientID, s.conn)
+	s.subnets = append(slices.Clone(s.subnets), subnet)
+	conn, prefixes := s.conn, slices.Concat(s.assigned, s.subnets)
+	t.mu.Unlock()
+	return assignClientPrefixes(conn, prefixes)
+}
+
+// Remove 在管理员删除客户端子网后立即删除路由，停止向该客户端转发这个子网的流量，并重新下发地址分配
+func (t *subnetRouteTable) Remove(clientID string, subnet netip.Prefix) {
+	t.mu.Lock()
+	if route, ok := t.routes[subnet]; ok && route.clientID == clientID {
+		t.dispatcher.Unregister(subnet, route.conn)
+		t.remove(subnet)
+	}
+	s, ok := t.sessions[clientID]
+	if !ok || !slices.Contains(s.subnets, subnet) {
+		t.mu.Unlock()
+		return
+	}
+	s.subnets = slices.DeleteFunc(slices.Clone(s.subnets), func(p netip.Prefix) bool { return p == subnet })
+	conn, prefixes := s.conn, slices.Concat(s.assigned, s.subnets)
+	t.mu.Unlock()
+	if err := assignClientPrefixes(conn, prefixes); err != nil {
+		log.Printf("Failed to push address assignment to client %s: %v", clientID, err)
+	}
+}
+
+// RemoveClient 删除客户端的全部子网路由
+func (t *subnetRouteTable) RemoveClient(clientID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for subnet, route := range t.routes {
+		if route.clientID == clientID {
+			t.dispatcher.Unregister(subnet, route.conn)
+			t.remove(subnet)
+		}
+	}
+	delete(t.sessions, clientID)
+}
+
+// Close 删除全部子网路由，服务器退出时调用
+func (t *subnetRouteTable) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for subnet := range t.routes {
+		t.remove(subnet)
+	}
+}
+
+// assignClientPrefixes 向已连接的客户端重新下发地址和路由子网
+func assignClientPrefixes(conn *connectip.Conn, prefixes []netip.Prefix) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return conn.AssignAddresses(ctx, prefixes)
+}
+
+// parseAdvertiseRoutes 将 advertise_routes 中的 CIDR 转换为 CONNECT-IP 路由
+func parseAdvertiseRoutes(routeStrs []string) ([]connectip.IPRoute, error) {
+	var routes []connectip.IPRoute
+	for _, routeStr := range routeStrs {
+		prefix, err := netip.ParsePrefix(routeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route in advertise_routes '%s': %v", routeStr, err)
+		}
+		prefix = prefix.Masked()
+		routes = append(routes, connectip.IPRoute{
+			StartIP:    prefix.Addr(),
+			EndIP:      common.LastIP(prefix),
+			IPProtocol: 0, // 0 表示任何协议
+		})
+	}
+	return routes, nil
+}
+
+// reloadAdvertiseRoutes 重新读取配置文件中的 advertise_routes，路由变化时推送给所有已连接的客户端
+func reloadAdvertiseRoutes(configFile string, adv *routeAdvertisement, ipPoolMu *sync.Mutex, ipConnMap map[netip.Addr]*connectip.Conn) {
+	var cfg common.ServerConfig
+	if _, err := toml.DecodeFile(configFile, &cfg); err != nil {
+		log.Printf("Failed to reload config file %s: %v", configFile, err)
+		return
+	}
+	routes, err := parseAdvertiseRoutes(cfg.AdvertiseRoutes)
+	if err != nil {
+		log.Printf("Failed to reload advertise_routes: %v", err)
+		return
+	}
+	if !adv.Set(routes) {
+		log.Printf("advertise_routes unchanged after reload")
+		return
+	}
+	log.Printf("Advertised routes updated: %v", cfg.AdvertiseRoutes)
+
+	// 同一客户端的多个地址对应同一个连接，去重后逐个推送
 	ipPoolMu.Lock()
-	// 修复：只有当 clientID 还在 clientIPMap 时才释放，避免被 API 删除后重复释放
-	if ip, ok := clientIPMap[clientID]; ok && ip == assignedPrefix.Addr() {
-		ipPool.Release(assignedPrefix.Addr())
-		delete(clientIPMap, clientID)
-		delete(ipConnMap, assignedPrefix.Addr())
+	conns := make(map[*connectip.Conn]struct{})
+	for _, conn := range ipConnMap {
+		conns[conn] = struct{}{}
 	}
 	ipPoolMu.Unlock()
+	for conn := range conns {
+		go func(conn *connectip.Conn) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := conn.AdvertiseRoute(ctx, routes); err != nil {
+				log.Printf("Failed to push routes to client: %v", err)
+			}
+		}(conn)
+	}
+	log.Printf("Pushed %d routes to %d connected clients", len(routes), len(conns))
+}
+
+// buildIPPools 为每个网段创建地址池，并将 ipam_exclude / ipam_reserved 中的范围分配到所属网段
+func buildIPPools(networks []*common.NetworkInfo, cfg common.ServerConfig) (*common.IPPoolSet, error) {
+	opts := make([]common.IPPoolOptions, len(networks))
+	assign := func(items []string, add func(*common.IPPoolOptions, common.IPRange)) error {
+		for _, item := range items {
+			r, err := common.ParseIPRange(item)
+			if err != nil {
+				return err
+			}
+			found := false
+			for i, n := range networks {
+				if n.GetPrefix().Contains(r.From) && n.GetPrefix().Contains(r.To) {
+					add(&opts[i], r)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("IP range %s is not within any assign_cidr", r)
+			}
+		}
+		return nil
+	}
+	if err := assign(cfg.IPAMExclude, func(o *common.IPPoolOptions, r common.IPRange) { o.Exclude = append(o.Exclude, r) }); err != nil {
+		return nil, err
+	}
+	if err := assign(cfg.IPAMReserved, func(o *common.IPPoolOptions, r common.IPRange) { o.Reserved = append(o.Reserved, r) }); err != nil {
+		return nil, err
+	}
+
+	var pools []common.IPAllocator
+	for i, n := range networks {
+		pool, err := common.NewIPPool(n.GetPrefix(), n.GetGateway().Addr(), opts[i])
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return common.NewIPPoolSet(pools)
+}
+
+// releaseClientAddresses 释放连接持有的地址
+// 如果地址已被同一客户端的新连接接管（断线重连），则保留给新连接
+func releaseClientAddresses(conn *connectip.Conn, clientID string, prefixes []netip.Prefix,
+	ipPool *common.IPPoolSet, ipPoolMu *sync.Mutex, clientIPMap map[string]netip.Addr, ipConnMap map[netip.Addr]*connectip.Conn) {
+	ipPoolMu.Lock()
+	defer ipPoolMu.Unlock()
+	for _, prefix := range prefixes {
+		addr := prefix.Addr()
+		if owner, ok := ipConnMap[addr]; ok && owner != conn {
+			continue
+		}
+		ipPool.Release(addr)
+		delete(ipConnMap, addr)
+		if ip, ok := clientIPMap[clientID]; ok && ip == addr {
+			delete(clientIPMap, clientID)
+		}
+	}
 }
 
 // getGroupsAndPoliciesForClient 也需要 dbPath 参数
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// natTableName 是服务器管理的 nftables 表，所有规则都放在这张独立的表中，清理时整表删除
+const natTableName = "masque_vpn"
+
+// setupNAT 为 VPN 网段安装 nftables 伪装（masquerade）和转发规则，使客户端可以经由 egress 接口访问外网
+// 返回的清理函数会删除安装的规则。注意：其他表（例如 Docker 或 iptables 的 FORWARD DROP）中的丢弃规则
+// 仍然优先生效，这里的 accept 无法覆盖它们。
+func setupNAT(egress string, tunName string, cidrs []netip.Prefix) (func(), error) {
+	if _, err := net.InterfaceByName(egress); err != nil {
+		return nil, fmt.Errorf("egress interface %s not found: %v", egress, err)
+	}
+
+	var b strings.Builder
+	// 先创建再删除，清除上次异常退出残留的规则，整个脚本原子生效
+	fmt.Fprintf(&b, "table inet %s {}\n", natTableName)
+	fmt.Fprintf(&b, "delete table inet %s\n", natTableName)
+	fmt.Fprintf(&b, "table inet %s {\n", natTableName)
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, cidr := range cidrs {
+		family := "ip"
+		if cidr.Addr().Is6() {
+			family = "ip6"
+		}
+		fmt.Fprintf(&b, "\t\t%s saddr %s oifname %q masquerade\n", family, cidr.Masked(), egress)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q oifname %q accept\n", tunName, egress)
+	fmt.Fprintf(&b, "\t\tiifname %q oifname %q ct state established,related accept\n", egress, tunName)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+
+	if err := runNft(b.String()); err != nil {
+		return nil, err
+	}
+	log.Printf("Installed nftables NAT rules for %v via %s (table inet %s)", cidrs, egress, natTableName)
+
+	return func() {
+		if err := runNft(fmt.Sprintf("delete table inet %s\n", natTableName)); err != nil {
+			log.Printf("Warning: failed to remove nftables NAT rules: %v", err)
+			return
+		}
+		log.Printf("Removed nftables NAT rules (table inet %s)", natTableName)
+	}, nil
+}
+
+// runNft 通过 nft -f - 执行规则脚本
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
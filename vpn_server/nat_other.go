@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// setupNAT 仅支持 Linux（nftables）
+func setupNAT(egress string, tunName string, cidrs []netip.Prefix) (func(), error) {
+	return nil, fmt.Errorf("NAT management is only supported on Linux")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// 未配置 client_cert_validity_days 时客户端证书的有效期
+const defaultClientCertValidity = 3 * 365 * 24 * time.Hour
+
+// clientCertValidity 返回配置的客户端证书有效期
+func clientCertValidity(cfg common.ServerConfig) time.Duration {
+	if cfg.ClientCertValidityDays > 0 {
+		return time.Duration(cfg.ClientCertValidityDays) * 24 * time.Hour
+	}
+	return defaultClientCertValidity
+}
+
+// issueClientCert 使用 CA 为 clientID 签发客户端证书，返回解析后的证书和 PEM 编码
+func issueClientCert(caCert *x509.Certificate, caKey crypto.Signer, clientID string, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, []byte, error) {
+	// 只有 RSA 密钥交换需要 KeyEncipherment，ECDSA/Ed25519 证书只用于签名
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	// 吊销和 CRL 以序列号为准，序列号必须随机且不可预测
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"MasqueVPN Client"},
+			CommonName:   clientID,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, pub, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// randomSerialNumber 生成 128 位随机序列号
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// createCA 生成自签名的根 CA 证书
+func createCA(key crypto.Signer, commonName string, validity time.Duration) (*x509.Certificate, []byte, error) {
+	return createCACert(nil, key, key.Public(), commonName, validity)
+}
+
+// createIntermediateCA 使用根 CA 签发只能签发终端证书的中间 CA
+func createIntermediateCA(parent *x509.Certificate, parentKey crypto.Signer, pub crypto.PublicKey, commonName string, validity time.Duration) (*x509.Certificate, []byte, error) {
+	return createCACert(parent, parentKey, pub, commonName, validity)
+}
+
+// createCACert 在 parent 为空时生成自签名证书，否则由 parent 签发路径长度为 0 的中间 CA
+func createCACert(parent *x509.Certificate, signer crypto.Signer, pub crypto.PublicKey, commonName string, validity time.Duration) (*x509.Certificate, []byte, error) {
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"MasqueVPN"}, CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent = &template
+	} else {
+		template.MaxPathLenZero = true
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, pub, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// issueServerCert 使用 CA 签发服务器证书，hosts 中的 IP 写入 IP SAN，其余写入 DNS SAN
+func issueServerCert(caCert *x509.Certificate, caKey crypto.Signer, pub crypto.PublicKey, commonName string, hosts []string, validity time.Duration) ([]byte, error) {
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"MasqueVPN Server"}, CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// csrKeyType 返回 CSR 公钥的密钥类型；want 非空时要求与之一致
+func csrKeyType(csr *x509.CertificateRequest, want string) (string, error) {
+	keyType := common.KeyTypeOf(csr.PublicKey)
+	if keyType == "" {
+		return "", errors.New("不支持的密钥类型或强度")
+	}
+	if want != "" && keyType != want {
+		return "", fmt.Errorf("CSR密钥类型 %s 与注册时指定的 %s 不一致", keyType, want)
+	}
+	return keyType, nil
+}
+
+// issuingCA 为签发客户端证书的 CA，可以是根 CA，也可以是由离线根 CA 签发的中间 CA
+type issuingCA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	// Chain 为签发 CA 之上直到根 CA 的证书，签发 CA 本身是根 CA 时为空
+	Chain []*x509.Certificate
+}
+
+// TrustPEM 返回签发 CA 及其证书链，写入客户端配置的 ca_pem
+func (ca *issuingCA) TrustPEM() []byte {
+	var buf []byte
+	for _, cert := range append([]*x509.Certificate{ca.Cert}, ca.Chain...) {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return buf
+}
+
+// LeafChainPEM 在签发的证书后附加中间 CA（不含自签名的根 CA），客户端握手时发送完整的证书链
+func (ca *issuingCA) LeafChainPEM(leafPEM []byte) []byte {
+	buf := append([]byte(nil), leafPEM...)
+	for _, cert := range append([]*x509.Certificate{ca.Cert}, ca.Chain...) {
+		if isSelfSigned(cert) {
+			continue
+		}
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return buf
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// parseCertsPEM 解析 PEM 中的全部证书
+func parseCertsPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("未找到证书")
+	}
+	return certs, nil
+}
+
+// loadCA 加载签发 CA 的证书和私钥，优先使用配置中内嵌的 PEM，否则读取文件
+// CA 证书文件可以直接包含完整的证书链，也可以通过 ca_chain_file/ca_chain_pem 单独提供
+// 返回的错误信息可以直接展示给管理员
+func loadCA(cfg common.ServerConfig) (*issuingCA, error) {
+	var caCertPEM, caKeyPEM []byte
+	var err error
+	if cfg.CACertPEM != "" && cfg.CAKeyPEM != "" {
+		caCertPEM = []byte(cfg.CACertPEM)
+		caKeyPEM = []byte(cfg.CAKeyPEM)
+	} else {
+		caCertPEM, err = os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, errors.New("CA证书不存在，请先生成CA")
+		}
+		caKeyPEM, err = os.ReadFile(cfg.CAKeyFile)
+		if err != nil {
+			return nil, errors.New("CA私钥不存在，请先生成CA")
+		}
+	}
+	// 支持 RSA、ECDSA P-256/P-384 和 Ed25519，PKCS#1、SEC 1、PKCS#8 格式均可
+	caKey, err := common.ParsePrivateKeyPEM(caKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("解析CA私钥失败: %v", err)
+	}
+	certs, err := parseCertsPEM(caCertPEM)
+	if err != nil {
+		return nil, errors.New("解析CA证书失败")
+	}
+	chainPEM, err := loadCAChainPEM(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if chainPEM != nil {
+		chain, err := parseCertsPEM(chainPEM)
+		if err != nil {
+			return nil, errors.New("解析CA证书链失败")
+		}
+		certs = append(certs, chain...)
+	}
+	ca := &issuingCA{Cert: certs[0], Key: caKey, Chain: certs[1:]}
+	if pub, ok := ca.Cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(caKey.Public()) {
+		return nil, errors.New("CA私钥与CA证书不匹配")
+	}
+	if err := ca.verifyChain(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// loadCAChainPEM 读取签发 CA 之上的证书链，未配置时返回 nil
+func loadCAChainPEM(cfg common.ServerConfig) ([]byte, error) {
+	if cfg.CAChainPEM != "" {
+		return []byte(cfg.CAChainPEM), nil
+	}
+	if cfg.CAChainFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.CAChainFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取CA证书链失败: %v", err)
+	}
+	return data, nil
+}
+
+// verifyChain 确认签发 CA 能通过证书链验证到链中的根 CA
+func (ca *issuingCA) verifyChain() error {
+	if len(ca.Chain) == 0 {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for _, cert := range ca.Chain {
+		if isSelfSigned(cert) {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := ca.Cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("CA证书链校验失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// CSR 请求体的最大长度
+	maxCSRSize = 64 << 10
+	// 续期后上一张证书的宽限期：客户端在此期间用新证书连接，或宽限期结束后，上一张证书被吊销
+	prevCertGracePeriod = 24 * time.Hour
+	// 检查上一张证书宽限期的间隔
+	prevCertSweepInterval = time.Hour
+)
+
+// handleCertRenewal 处理已连接客户端通过 mTLS 提交的证书续期请求
+// 请求体为 PEM 编码的 CSR，私钥始终留在客户端；新证书的 CN 固定为当前证书中的 client_id
+func handleCertRenewal(cfg common.ServerConfig, revocations *RevocationList, bindings *CertBindings) http.HandlerFunc {
+	dbPath := cfg.APIServer.DatabasePath
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "未检测到客户端证书", http.StatusUnauthorized)
+			return
+		}
+		clientID, ok := bindings.Authorize(r.TLS.PeerCertificates[0])
+		if !ok {
+			http.Error(w, "客户端未授权或已被删除", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxCSRSize))
+		if err != nil {
+			http.Error(w, "读取请求失败", http.StatusBadRequest)
+			return
+		}
+		csr, err := parseCSR(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// 续期时允许更换密钥算法
+		keyType, err := csrKeyType(csr, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ca, err := loadCA(cfg)
+		if err != nil {
+			log.Printf("客户端 %s 续期失败: %v", clientID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cert, certPEM, err := issueClientCert(ca.Cert, ca.Key, clientID, csr.PublicKey, clientCertValidity(cfg))
+		if err != nil {
+			log.Printf("客户端 %s 续期失败: %v", clientID, err)
+			http.Error(w, "签发证书失败", http.StatusInternalServerError)
+			return
+		}
+		if err := updateClientCert(dbPath, revocations, bindings, clientID, cert, certPEM, keyType, serialKey(r.TLS.PeerCertificates[0].SerialNumber)); err != nil {
+			log.Printf("保存客户端 %s 的新证书失败: %v", clientID, err)
+			http.Error(w, "写入数据库失败", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("已为客户端 %s 续期证书 (serial: %s, 到期: %s)", clientID, serialKey(cert.SerialNumber), cert.NotAfter.Format("2006-01-02"))
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(ca.LeafChainPEM(certPEM))
+	}
+}
+
+// updateClientCert 保存客户端的新证书并更新证书绑定，usedSerial 为续期请求使用的证书序列号，注册时为空
+// 服务器不持有新证书对应的私钥，因此清空 key_pem
+//   - 用当前证书续期：原证书作为上一张证书在宽限期内保留绑定，续期响应丢失时客户端仍可用它连接并再次续期
+//   - 用上一张证书续期：说明客户端没有收到上次续期的证书，直接吊销那张从未使用的证书；
+//     上一张证书的宽限期不会延长，持有旧证书的一方不能借此无限续期
+//   - 注册：吊销可能残留的旧证书
+func updateClientCert(dbPath string, revocations *RevocationList, bindings *CertBindings, clientID string, cert *x509.Certificate, certPEM []byte, keyType, usedSerial string) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var curSerial, curFP, prevSerial, prevFP sql.NullString
+	var prevUntil sql.NullTime
+	err = db.QueryRow("SELECT cert_serial, cert_fingerprint, prev_cert_serial, prev_cert_fingerprint, prev_cert_until FROM clients WHERE client_id = ?", clientID).
+		Scan(&curSerial, &curFP, &prevSerial, &prevFP, &prevUntil)
+	if err != nil {
+		return err
+	}
+	var revoke []string
+	switch {
+	case usedSerial != "" && usedSerial == prevSerial.String:
+		revoke = append(revoke, curSerial.String)
+	case usedSerial != "" && usedSerial == curSerial.String:
+		revoke = append(revoke, prevSerial.String)
+		prevSerial, prevFP = curSerial, curFP
+		prevUntil = sql.NullTime{Time: time.Now().Add(prevCertGracePeriod), Valid: true}
+	default:
+		revoke = append(revoke, curSerial.String, prevSerial.String)
+		prevSerial, prevFP, prevUntil = sql.NullString{}, sql.NullString{}, sql.NullTime{}
+	}
+	for _, serial := range revoke {
+		if serial == "" {
+			continue
+		}
+		if err := revocations.RevokeSerial(serial, clientID, "superseded"); err != nil {
+			return err
+		}
+	}
+	var prevUntilDB sql.NullString
+	if prevUntil.Valid {
+		prevUntilDB = sql.NullString{String: formatDBTime(prevUntil.Time), Valid: true}
+	}
+	_, err = db.Exec(`UPDATE clients SET cert_pem = ?, key_pem = '', cert_serial = ?, cert_not_after = ?, key_type = ?, cert_fingerprint = ?,
+		prev_cert_serial = ?, prev_cert_fingerprint = ?, prev_cert_until = ? WHERE client_id = ?`,
+		string(certPEM), serialKey(cert.SerialNumber), formatDBTime(cert.NotAfter), keyType, certFingerprint(cert),
+		prevSerial, prevFP, prevUntilDB, clientID)
+	if err != nil {
+		return err
+	}
+	return bindings.Refresh(clientID)
+}
+
+// retirePrevCert 吊销客户端续期前的上一张证书并解除其绑定，没有上一张证书时什么也不做；调用方需要刷新 CertBindings
+func retirePrevCert(db *sql.DB, revocations *RevocationList, clientID, reason string) error {
+	var prevSerial sql.NullString
+	if err := db.QueryRow("SELECT prev_cert_serial FROM clients WHERE client_id = ?", clientID).Scan(&prevSerial); err != nil {
+		return err
+	}
+	if prevSerial.String != "" {
+		if err := revocations.RevokeSerial(prevSerial.String, clientID, reason); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("UPDATE clients SET prev_cert_serial = NULL, prev_cert_fingerprint = NULL, prev_cert_until = NULL WHERE client_id = ?", clientID)
+	return err
+}
+
+// confirmCurrentCert 在客户端用新证书连接后吊销上一张证书
+func confirmCurrentCert(dbPath string, revocations *RevocationList, bindings *CertBindings, clientID string) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Printf("吊销客户端 %s 的上一张证书失败: %v", clientID, err)
+		return
+	}
+	defer db.Close()
+	if err := retirePrevCert(db, revocations, clientID, "superseded"); err != nil {
+		log.Printf("吊销客户端 %s 的上一张证书失败: %v", clientID, err)
+	}
+	if err := bindings.Refresh(clientID); err != nil {
+		log.Printf("刷新客户端 %s 的证书绑定失败: %v", clientID, err)
+	}
+}
+
+// retireExpiredPrevCerts 吊销宽限期已结束的上一张证书
+func retireExpiredPrevCerts(dbPath string, revocations *RevocationList, bindings *CertBindings) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT client_id FROM clients WHERE prev_cert_serial IS NOT NULL AND (prev_cert_until IS NULL OR prev_cert_until <= ?)",
+		formatDBTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	var clientIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			clientIDs = append(clientIDs, id)
+		}
+	}
+	rows.Close()
+	for _, id := range clientIDs {
+		if err := retirePrevCert(db, revocations, id, "superseded"); err != nil {
+			return err
+		}
+		if err := bindings.Refresh(id); err != nil {
+			log.Printf("刷新客户端 %s 的证书绑定失败: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// watchPrevCerts 定期吊销宽限期已结束的上一张证书，直到 ctx 取消
+func watchPrevCerts(ctx context.Context, dbPath string, revocations *RevocationList, bindings *CertBindings) {
+	ticker := time.NewTicker(prevCertSweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := retireExpiredPrevCerts(dbPath, revocations, bindings); err != nil {
+			log.Printf("吊销过期的上一张客户端证书失败: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
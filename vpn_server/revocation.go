@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// CRL 的有效期，客户端/第三方应在 NextUpdate 之前重新拉取
+	crlValidity = 7 * 24 * time.Hour
+	// 缓存的 CRL 超过该时间后重新签发，保证 ThisUpdate 不会太旧
+	crlRefreshInterval = time.Hour
+)
+
+// RevokedCert 为一条吊销记录
+type RevokedCert struct {
+	Serial    string    `json:"serial"`
+	ClientID  string    `json:"client_id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    string    `json:"reason"`
+}
+
+// RevocationList 维护已吊销证书序列号的内存缓存，握手时只查内存不访问数据库；
+// 同时负责生成由 CA 签名的 CRL
+type RevocationList struct {
+	dbPath string
+	cfg    common.ServerConfig
+
+	mu      sync.RWMutex
+	serials map[string]struct{}
+
+	crlMu       sync.Mutex
+	crlDER      []byte
+	crlIssuedAt time.Time
+}
+
+// NewRevocationList 从数据库加载已吊销的序列号
+func NewRevocationList(dbPath string, cfg common.ServerConfig) (*RevocationList, error) {
+	r := &RevocationList{
+		dbPath:  dbPath,
+		cfg:     cfg,
+		serials: make(map[string]struct{}),
+	}
+	list, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, rc := range list {
+		r.serials[rc.Serial] = struct{}{}
+	}
+	return r, nil
+}
+
+func serialKey(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// IsRevoked 判断序列号是否已被吊销
+func (r *RevocationList) IsRevoked(serial *big.Int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.serials[serialKey(serial)]
+	return ok
+}
+
+// Revoke 吊销证书并持久化，重复吊销不会报错
+func (r *RevocationList) Revoke(cert *x509.Certificate, clientID, reason string) error {
+	return r.RevokeSerial(serialKey(cert.SerialNumber), clientID, reason)
+}
+
+// RevokeSerial 按序列号（serialKey 格式）吊销证书，用于服务器只保存了序列号的证书
+func (r *RevocationList) RevokeSerial(key, clientID, reason string) error {
+	db, err := sql.Open("sqlite3", r.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT OR IGNORE INTO revoked_certs(serial, client_id, revoked_at, reason) VALUES (?, ?, ?, ?)",
+		key, clientID, time.Now().UTC(), reason)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.serials[key] = struct{}{}
+	r.mu.Unlock()
+
+	// 使缓存的 CRL 失效，下次请求时重新签发
+	r.crlMu.Lock()
+	r.crlDER = nil
+	r.crlMu.Unlock()
+	log.Printf("已吊销客户端 %s 的证书 (serial: %s)", clientID, key)
+	return nil
+}
+
+// List 返回所有吊销记录，按吊销时间排序
+func (r *RevocationList) List() ([]RevokedCert, error) {
+	db, err := sql.Open("sqlite3", r.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT serial, client_id, revoked_at, reason FROM revoked_certs ORDER BY revoked_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []RevokedCert
+	for rows.Next() {
+		var rc RevokedCert
+		var clientID, reason sql.NullString
+		if err := rows.Scan(&rc.Serial, &clientID, &rc.RevokedAt, &reason); err != nil {
+			return nil, err
+		}
+		rc.ClientID = clientID.String
+		rc.Reason = reason.String
+		list = append(list, rc)
+	}
+	return list, rows.Err()
+}
+
+// VerifyConnection 用作 tls.Config 的回调，拒绝已吊销的客户端证书
+// 与 VerifyPeerCertificate 不同，它在会话恢复（resumption）时同样会被调用
+func (r *RevocationList) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	if leaf := cs.PeerCertificates[0]; r.IsRevoked(leaf.SerialNumber) {
+		return fmt.Errorf("client certificate %s has been revoked", serialKey(leaf.SerialNumber))
+	}
+	return nil
+}
+
+// CRL 返回 DER 编码、由 CA 签名的证书吊销列表
+func (r *RevocationList) CRL() ([]byte, error) {
+	r.crlMu.Lock()
+	defer r.crlMu.Unlock()
+	if r.crlDER != nil && time.Since(r.crlIssuedAt) < crlRefreshInterval {
+		return r.crlDER, nil
+	}
+
+	ca, err := loadCA(r.cfg)
+	if err != nil {
+		return nil, err
+	}
+	list, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(list))
+	for _, rc := range list {
+		serial, ok := new(big.Int).SetString(rc.Serial, 16)
+		if !ok {
+			log.Printf("忽略无效的吊销序列号: %s", rc.Serial)
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: rc.RevokedAt,
+		})
+	}
+
+	// gen_ca.sh 旧版本生成的 CA 没有 keyUsage 扩展（即不限制用途），
+	// 但标准库要求签发者带有 cRLSign，这里用副本补上
+	issuer := ca.Cert
+	if issuer.KeyUsage == 0 {
+		cp := *ca.Cert
+		cp.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		issuer = &cp
+	}
+	if issuer.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, errors.New("CA证书不允许签发CRL")
+	}
+
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, issuer, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("签发CRL失败: %w", err)
+	}
+	r.crlDER = der
+	r.crlIssuedAt = now
+	return der, nil
+}
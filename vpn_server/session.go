@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// 会话 Cookie，HttpOnly
+	sessionCookieName = "masque_admin_sid"
+	// CSRF 令牌 Cookie，前端读取后放入 csrfHeaderName 请求头（axios 会自动处理）
+	csrfCookieName = "masque_admin_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+
+	// 未配置时的空闲超时和最长有效期
+	defaultSessionIdleTimeout = 30 * time.Minute
+	defaultSessionMaxLifetime = 12 * time.Hour
+	// last_seen 的更新间隔，避免每个请求都写数据库
+	sessionTouchInterval = time.Minute
+)
+
+var errSessionNotFound = errors.New("未登录或会话已过期")
+
+// AdminSession 为一个管理员登录会话
+type AdminSession struct {
+	ID        string    `json:"id"` // 会话 ID 的摘要，可以公开用于吊销，不能用来登录
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+
+	// 账号的角色和是否需要修改密码，每次请求都从 admin 表读取，修改后立即生效
+	Role               string `json:"-"`
+	MustChangePassword bool   `json:"-"`
+
+	csrfToken string
+}
+
+// SessionStore 将管理员会话保存在 SQLite 中，服务器重启后会话仍然有效
+// 会话在空闲超时或达到最长有效期后失效，数据库中只保存会话 ID 的摘要
+type SessionStore struct {
+	dbPath       string
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	secureCookie bool
+	// 可信反向代理，只有来自这些地址的 X-Forwarded-Proto 才会被采信
+	trustedProxies []netip.Prefix
+}
+
+// NewSessionStore 按 api_server 配置创建会话存储
+func NewSessionStore(dbPath string, cfg common.APIServerConfig) *SessionStore {
+	s := &SessionStore{
+		dbPath:       dbPath,
+		idleTimeout:  defaultSessionIdleTimeout,
+		maxLifetime:  defaultSessionMaxLifetime,
+		secureCookie: cfg.CookieSecure,
+	}
+	if cfg.SessionIdleTimeoutMinutes > 0 {
+		s.idleTimeout = time.Duration(cfg.SessionIdleTimeoutMinutes) * time.Minute
+	}
+	if cfg.SessionMaxLifetimeHours > 0 {
+		s.maxLifetime = time.Duration(cfg.SessionMaxLifetimeHours) * time.Hour
+	}
+	// 服务器启动时已经检查过 trusted_proxies
+	s.trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+	return s
+}
+
+// parseTrustedProxies 解析 trusted_proxies，格式与 gin 的 SetTrustedProxies 相同：单个地址或 CIDR
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// fromTrustedProxy 判断请求是否直接来自可信反向代理
+func (s *SessionStore) fromTrustedProxy(c *gin.Context) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create 为登录成功的管理员创建会话并设置 Cookie
+func (s *SessionStore) Create(c *gin.Context, username string) (*AdminSession, error) {
+	sid, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	now := time.Now()
+	s.purgeExpired(db, now)
+	sess := &AdminSession{
+		ID:        hashToken(sid),
+		Username:  username,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(s.maxLifetime),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Current:   true,
+		csrfToken: csrf,
+	}
+	err = db.QueryRow("SELECT role, must_change_password FROM admin WHERE username = ?", username).Scan(&sess.Role, &sess.MustChangePassword)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("INSERT INTO admin_sessions(id_hash, username, csrf_token, created_at, last_seen, expires_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		sess.ID, username, csrf, formatDBTime(now), formatDBTime(now), formatDBTime(sess.ExpiresAt), sess.IP, sess.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	s.setCookies(c, sid, csrf, int(s.maxLifetime.Seconds()))
+	return sess, nil
+}
+
+// purgeExpired 删除已超时的会话
+func (s *SessionStore) purgeExpired(db *sql.DB, now time.Time) {
+	db.Exec("DELETE FROM admin_sessions WHERE expires_at <= ? OR last_seen <= ?",
+		formatDBTime(now), formatDBTime(now.Add(-s.idleTimeout)))
+}
+
+// Lookup 返回请求 Cookie 对应的有效会话，并刷新空闲计时；账号被删除后其会话随之失效
+func (s *SessionStore) Lookup(c *gin.Context) (*AdminSession, error) {
+	sid, err := c.Cookie(sessionCookieName)
+	if err != nil || sid == "" {
+		return nil, errSessionNotFound
+	}
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	now := time.Now()
+	sess := &AdminSession{ID: hashToken(sid), Current: true}
+	err = db.QueryRow(`SELECT s.username, s.csrf_token, s.created_at, s.last_seen, s.expires_at, s.ip, s.user_agent, a.role, a.must_change_password
+		FROM admin_sessions s JOIN admin a ON a.username = s.username
+		WHERE s.id_hash = ? AND s.expires_at > ? AND s.last_seen > ?`,
+		sess.ID, formatDBTime(now), formatDBTime(now.Add(-s.idleTimeout))).
+		Scan(&sess.Username, &sess.csrfToken, &sess.CreatedAt, &sess.LastSeen, &sess.ExpiresAt, &sess.IP, &sess.UserAgent, &sess.Role, &sess.MustChangePassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(sess.LastSeen) >= sessionTouchInterval {
+		if _, err := db.Exec("UPDATE admin_sessions SET last_seen = ? WHERE id_hash = ?", formatDBTime(now), sess.ID); err == nil {
+			sess.LastSeen = now
+		}
+	}
+	return sess, nil
+}
+
+// List 返回未过期的会话，按最近活动时间排序；username 非空时只返回该账号的会话
+func (s *SessionStore) List(username string) ([]AdminSession, error) {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	now := time.Now()
+	s.purgeExpired(db, now)
+	rows, err := db.Query("SELECT id_hash, username, created_at, last_seen, expires_at, ip, user_agent FROM admin_sessions WHERE ? = '' OR username = ? ORDER BY last_seen DESC",
+		username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []AdminSession
+	for rows.Next() {
+		var sess AdminSession
+		if err := rows.Scan(&sess.ID, &sess.Username, &sess.CreatedAt, &sess.LastSeen, &sess.ExpiresAt, &sess.IP, &sess.UserAgent); err != nil {
+			return nil, err
+		}
+		list = append(list, sess)
+	}
+	return list, rows.Err()
+}
+
+// Delete 吊销会话，username 非空时只能吊销该账号的会话；会话不存在时返回 errSessionNotFound
+func (s *SessionStore) Delete(id, username string) error {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	res, err := db.Exec("DELETE FROM admin_sessions WHERE id_hash = ? AND (? = '' OR username = ?)", id, username, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+// DeleteUserSessions 吊销账号的全部会话，exceptID 非空时保留该会话
+func (s *SessionStore) DeleteUserSessions(username, exceptID string) error {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("DELETE FROM admin_sessions WHERE username = ? AND id_hash != ?", username, exceptID)
+	return err
+}
+
+// setCookies 设置会话和 CSRF Cookie，maxAge 为负数时删除
+// 通过 HTTPS 访问（或可信反向代理声明为 HTTPS）时自动加上 Secure，cookie_secure 可以强制开启
+func (s *SessionStore) setCookies(c *gin.Context, sid, csrf string, maxAge int) {
+	secure := s.secureCookie || c.Request.TLS != nil || (c.GetHeader("X-Forwarded-Proto") == "https" && s.fromTrustedProxy(c))
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, sid, maxAge, "/", "", secure, true)
+	c.SetCookie(csrfCookieName, csrf, maxAge, "/", "", secure, false)
+}
+
+func (s *SessionStore) clearCookies(c *gin.Context) {
+	s.setCookies(c, "", "", -1)
+}
+
+// validCSRF 校验请求头中的 CSRF 令牌，只读请求不需要
+func (sess *AdminSession) validCSRF(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := c.GetHeader(csrfHeaderName)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrfToken)) == 1
+}
+
+// currentSession 返回 ginRequireAuth 保存的当前会话
+func currentSession(c *gin.Context) *AdminSession {
+	return c.MustGet("session").(*AdminSession)
+}
+
+// ginRequireAuth 校验登录会话，或 Authorization: Bearer 请求头中的 API 令牌
+// API 令牌只能访问其权限范围内的接口，不使用 Cookie，因此不需要 CSRF 令牌
+func ginRequireAuth(sessions *SessionStore, tokens *APITokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if raw, ok := bearerToken(c); ok {
+			tok, err := tokens.Authenticate(raw)
+			if err != nil {
+				if !errors.Is(err, errInvalidAPIToken) {
+					c.AbortWithStatusJSON(500, gin.H{"error": "查询令牌失败"})
+					return
+				}
+				c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+				return
+			}
+			if !tok.allows(c) {
+				c.AbortWithStatusJSON(403, gin.H{"error": "API令牌无权访问该接口"})
+				return
+			}
+			c.Set("api_token", tok)
+			c.Next()
+			return
+		}
+		sess, err := sessions.Lookup(c)
+		if err != nil {
+			if !errors.Is(err, errSessionNotFound) {
+				c.AbortWithStatusJSON(500, gin.H{"error": "查询会话失败"})
+				return
+			}
+			c.AbortWithStatusJSON(401, gin.H{"error": "未登录或会话已过期"})
+			return
+		}
+		if !sess.validCSRF(c) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "CSRF令牌无效"})
+			return
+		}
+		c.Set("session", sess)
+		c.Next()
+	}
+}
+
+// 登出：删除当前会话并清除 Cookie
+func ginHandleLogout(sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sid, err := c.Cookie(sessionCookieName); err == nil && sid != "" {
+			sessions.Delete(hashToken(sid), "")
+		}
+		sessions.clearCookies(c)
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Logged out successfully"})
+	}
+}
+
+// 会话检查，同时返回 CSRF 令牌供非浏览器客户端使用
+func ginHandleAuthCheck() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess := currentSession(c)
+		c.JSON(http.StatusOK, gin.H{
+			"loggedIn":             true,
+			"username":             sess.Username,
+			"role":                 sess.Role,
+			"must_change_password": sess.MustChangePassword,
+			"csrf_token":           sess.csrfToken,
+			"expires_at":           sess.ExpiresAt,
+		})
+	}
+}
+
+// sessionScope 返回当前账号可以管理的会话范围：超级管理员为全部会话，其他角色只能管理自己的会话
+func sessionScope(sess *AdminSession) string {
+	if hasRole(sess.Role, roleSuperadmin) {
+		return ""
+	}
+	return sess.Username
+}
+
+func ginHandleListSessions(sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current := currentSession(c)
+		list, err := sessions.List(sessionScope(current))
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		for i := range list {
+			list[i].Current = list[i].ID == current.ID
+		}
+		if list == nil {
+			list = []AdminSession{}
+		}
+		c.JSON(200, list)
+	}
+}
+
+// 吊销会话，吊销当前会话等同于登出
+func ginHandleRevokeSession(sessions *SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Query("id")
+		if id == "" {
+			c.JSON(400, gin.H{"error": "缺少id参数"})
+			return
+		}
+		if err := sessions.Delete(id, sessionScope(currentSession(c))); err != nil {
+			if errors.Is(err, errSessionNotFound) {
+				c.JSON(404, gin.H{"error": "会话不存在"})
+				return
+			}
+			c.JSON(500, gin.H{"error": "吊销会话失败"})
+			return
+		}
+		if id == currentSession(c).ID {
+			sessions.clearCookies(c)
+		}
+		c.String(200, "ok")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// 检查证书文件是否变化的间隔
+const tlsReloadInterval = 10 * time.Second
+
+// fileStamp 记录文件的修改时间和大小，用于判断文件是否被替换
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsReloader 在不重启服务器的情况下更新服务器证书和客户端 CA
+// 新的握手通过 GetConfigForClient 取得当前配置，已建立的 QUIC 连接不受影响
+type tlsReloader struct {
+	cfg     common.ServerConfig
+	base    *tls.Config // 除证书和 CA 之外的设置，每次重新加载时复制
+	current atomic.Pointer[tls.Config]
+
+	mu      sync.Mutex
+	stamps  map[string]fileStamp
+	lastErr string
+}
+
+// newTLSReloader 加载初始的证书和 CA，失败时返回错误
+func newTLSReloader(cfg common.ServerConfig, base *tls.Config) (*tlsReloader, error) {
+	r := &tlsReloader{cfg: cfg, base: base}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// loadServerTLSMaterial 加载服务器证书和用于校验客户端的 CA，配置中内嵌的 PEM 优先于文件
+func loadServerTLSMaterial(cfg common.ServerConfig) (tls.Certificate, *x509.CertPool, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.CertPEM != "" && cfg.KeyPEM != "" {
+		cert, err = tls.X509KeyPair([]byte(cfg.CertPEM), []byte(cfg.KeyPEM))
+		if err != nil {
+			return cert, nil, fmt.Errorf("failed to load TLS certificate/key from config PEM: %w", err)
+		}
+	} else {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return cert, nil, fmt.Errorf("failed to load TLS certificate/key: %w", err)
+		}
+	}
+
+	var caCert []byte
+	if cfg.CACertPEM != "" {
+		caCert = []byte(cfg.CACertPEM)
+	} else {
+		if cfg.CACertFile == "" {
+			return cert, nil, errors.New("ca_cert_file is required for mutual TLS authentication")
+		}
+		caCert, err = os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return cert, nil, fmt.Errorf("failed to read CA file %s: %w", cfg.CACertFile, err)
+		}
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return cert, nil, errors.New("failed to append CA cert")
+	}
+	// 签发 CA 之上的证书链，客户端只发送中间 CA 时也能校验到根 CA
+	chainPEM, err := loadCAChainPEM(cfg)
+	if err != nil {
+		return cert, nil, err
+	}
+	if chainPEM != nil && !caCertPool.AppendCertsFromPEM(chainPEM) {
+		return cert, nil, errors.New("failed to append CA chain")
+	}
+	// CA 轮换期间同时信任旧 CA 签发的客户端证书
+	for _, path := range cfg.ClientCAFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cert, nil, fmt.Errorf("failed to read client CA file %s: %w", path, err)
+		}
+		if !caCertPool.AppendCertsFromPEM(data) {
+			return cert, nil, fmt.Errorf("no certificates found in client CA file %s", path)
+		}
+	}
+	return cert, caCertPool, nil
+}
+
+// watchedFiles 返回需要监视的文件，内嵌在配置中的 PEM 不需要监视
+func (r *tlsReloader) watchedFiles() []string {
+	var files []string
+	if r.cfg.CertPEM == "" || r.cfg.KeyPEM == "" {
+		files = append(files, r.cfg.CertFile, r.cfg.KeyFile)
+	}
+	if r.cfg.CACertPEM == "" && r.cfg.CACertFile != "" {
+		files = append(files, r.cfg.CACertFile)
+	}
+	if r.cfg.CAChainPEM == "" && r.cfg.CAChainFile != "" {
+		files = append(files, r.cfg.CAChainFile)
+	}
+	return append(files, r.cfg.ClientCAFiles...)
+}
+
+func (r *tlsReloader) statFiles() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range r.watchedFiles() {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Reload 重新加载证书和 CA；失败时保留当前配置
+func (r *tlsReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 先记录文件状态再读取，读取期间文件再次变化时下一轮会重新加载
+	stamps := r.statFiles()
+	cert, caCertPool, err := loadServerTLSMaterial(r.cfg)
+	if err != nil {
+		return err
+	}
+	conf := r.base.Clone()
+	conf.Certificates = []tls.Certificate{cert}
+	conf.ClientCAs = caCertPool
+	r.current.Store(conf)
+	r.stamps = stamps
+	r.lastErr = ""
+	if cert.Leaf != nil {
+		log.Printf("Loaded TLS certificate %q (valid until %s)", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// changed 判断监视的文件相对上次成功加载时是否有变化
+func (r *tlsReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stamps := r.statFiles()
+	if len(stamps) != len(r.stamps) {
+		return true
+	}
+	for path, stamp := range stamps {
+		if old, ok := r.stamps[path]; !ok || !old.modTime.Equal(stamp.modTime) || old.size != stamp.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 定期检查证书文件，发生变化后重新加载，直到 ctx 取消
+// 证书和私钥可能不是同时替换的，加载失败时保留当前配置并在下一轮重试
+func (r *tlsReloader) Watch(ctx context.Context) {
+	if len(r.watchedFiles()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			r.mu.Lock()
+			if err.Error() != r.lastErr {
+				log.Printf("Warning: TLS certificate files changed but could not be reloaded, keeping the current certificate: %v", err)
+				r.lastErr = err.Error()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// GetConfigForClient 用作 tls.Config 的回调，为每个新握手返回当前的配置
+func (r *tlsReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return r.current.Load(), nil
+}
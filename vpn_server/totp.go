@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TOTP 参数（RFC 6238），与常见的身份验证器应用兼容
+const (
+	totpIssuer = "MasqueVPN"
+	totpPeriod = 30
+	totpDigits = 6
+	// 允许前后各一个时间步长的时钟偏差
+	totpSkew = 1
+
+	// 启用两步验证时生成的恢复码数量，每个恢复码只能使用一次
+	recoveryCodeCount = 10
+
+	// 密码验证通过后，完成第二步验证的时限和允许的尝试次数
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var (
+	errInvalidTOTPCode       = errors.New("验证码或恢复码错误")
+	errInvalidLoginChallenge = errors.New("登录已过期，请重新输入密码")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret 生成 160 位随机密钥，返回 base32 编码
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpURI 返回 otpauth:// 格式的配置 URI，身份验证器应用可以扫描其二维码添加账号
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// totpCode 计算指定时间步长的验证码（RFC 4226 HOTP）
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTOTP 校验验证码，返回匹配的时间步长；step 不大于 lastStep 的验证码已经用过，拒绝重放
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode 去掉用户输入中的分隔符和空白并转为大写
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// generateRecoveryCodes 为账号生成新的恢复码并替换旧的，数据库中只保存摘要
+func generateRecoveryCodes(db *sql.DB, username string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(buf)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM admin_recovery_codes WHERE username = ?", username); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO admin_recovery_codes(code_hash, username, created_at) VALUES (?, ?, ?)",
+			hashToken(normalizeRecoveryCode(code)), username, formatDBTime(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// verifySecondFactor 校验已启用两步验证的账号提交的验证码或恢复码，成功后验证码/恢复码作废
+func verifySecondFactor(db *sql.DB, username, code string) error {
+	code = strings.TrimSpace(code)
+	var secret string
+	var lastStep int64
+	err := db.QueryRow("SELECT totp_secret, totp_last_step FROM admin WHERE username = ? AND totp_enabled = 1", username).Scan(&secret, &lastStep)
+	if err != nil {
+		return errInvalidTOTPCode
+	}
+	if step, ok := verifyTOTP(secret, code, lastStep, time.Now()); ok {
+		// 条件更新保证并发提交同一个验证码时只有一个成功
+		res, err := db.Exec("UPDATE admin SET totp_last_step = ? WHERE username = ? AND totp_last_step < ?", step, username, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			return errInvalidTOTPCode
+		}
+		return nil
+	}
+	res, err := db.Exec("UPDATE admin_recovery_codes SET used_at = ? WHERE code_hash = ? AND username = ? AND used_at IS NULL",
+		formatDBTime(time.Now()), hashToken(normalizeRecoveryCode(code)), username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errInvalidTOTPCode
+	}
+	log.Printf("管理员 %s 使用恢复码登录", username)
+	return nil
+}
+
+// totpEnabled 返回账号是否已启用两步验证
+func totpEnabled(db *sql.DB, username string) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT totp_enabled FROM admin WHERE username = ?", username).Scan(&enabled)
+	return enabled, err
+}
+
+// disableTOTP 关闭账号的两步验证并删除恢复码
+func disableTOTP(db *sql.DB, username string) error {
+	if _, err := db.Exec("UPDATE admin SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0 WHERE username = ?", username); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM admin_recovery_codes WHERE username = ?", username)
+	return err
+}
+
+// createLoginChallenge 在密码验证通过后创建第二步验证的临时凭据
+func createLoginChallenge(db *sql.DB, username string) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	db.Exec("DELETE FROM admin_login_challenges WHERE expires_at <= ?", formatDBTime(now))
+	_, err = db.Exec("INSERT INTO admin_login_challenges(token_hash, username, expires_at, attempts) VALUES (?, ?, ?, 0)",
+		hashToken(token), username, formatDBTime(now.Add(loginChallengeTTL)))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useLoginChallenge 记录一次第二步验证尝试并返回对应的用户名，超过尝试次数后凭据作废
+func useLoginChallenge(db *sql.DB, token string) (string, error) {
+	res, err := db.Exec("UPDATE admin_login_challenges SET attempts = attempts + 1 WHERE token_hash = ? AND expires_at > ? AND attempts < ?",
+		hashToken(token), formatDBTime(time.Now()), loginChallengeMaxAttempts)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", errInvalidLoginChallenge
+	}
+	var username string
+	if err := db.QueryRow("SELECT username FROM admin_login_challenges WHERE token_hash = ?", hashToken(token)).Scan(&username); err != nil {
+		return "", errInvalidLoginChallenge
+	}
+	return username, nil
+}
+
+// 登录第二步：提交密码验证后得到的 challenge 和验证码（或恢复码）
+func ginHandleLoginTOTP(dbPath string, sessions *SessionStore, guard *LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Challenge string `json:"challenge"`
+			Code      string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Challenge == "" || req.Code == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		unlockIP := guard.lockIP(c.ClientIP())
+		defer unlockIP()
+		if err := guard.Check(db, "", c.ClientIP()); err != nil {
+			respondLoginBlocked(c, err)
+			return
+		}
+		username, err := useLoginChallenge(db, req.Challenge)
+		if err != nil {
+			guard.Record(db, c, "", loginEventTOTPFailure)
+			c.JSON(401, gin.H{"error": err.Error()})
+			return
+		}
+		unlockUser := guard.lockUser(username)
+		defer unlockUser()
+		if err := guard.Check(db, username, c.ClientIP()); err != nil {
+			respondLoginBlocked(c, err)
+			return
+		}
+		if err := verifySecondFactor(db, username, req.Code); err != nil {
+			log.Printf("管理员 %s 两步验证失败 (来自 %s)", username, c.ClientIP())
+			guard.Record(db, c, username, loginEventTOTPFailure)
+			c.JSON(401, gin.H{"error": errInvalidTOTPCode.Error()})
+			return
+		}
+		db.Exec("DELETE FROM admin_login_challenges WHERE token_hash = ?", hashToken(req.Challenge))
+		guard.Record(db, c, username, loginEventSuccess)
+		loginSuccessResponse(c, sessions, username)
+	}
+}
+
+// 查询当前账号的两步验证状态
+func ginHandleTOTPStatus(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		username := currentSession(c).Username
+		enabled, err := totpEnabled(db, username)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询失败"})
+			return
+		}
+		var remaining int
+		db.QueryRow("SELECT COUNT(*) FROM admin_recovery_codes WHERE username = ? AND used_at IS NULL", username).Scan(&remaining)
+		c.JSON(200, gin.H{"enabled": enabled, "recovery_codes_remaining": remaining})
+	}
+}
+
+// 开始启用两步验证：生成新密钥并返回配置 URI，提交验证码确认后才生效
+func ginHandleTOTPSetup(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		username := currentSession(c).Username
+		if enabled, err := totpEnabled(db, username); err != nil || enabled {
+			c.JSON(400, gin.H{"error": "两步验证已启用，请先关闭"})
+			return
+		}
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "生成密钥失败"})
+			return
+		}
+		if _, err := db.Exec("UPDATE admin SET totp_secret = ?, totp_last_step = 0 WHERE username = ?", secret, username); err != nil {
+			c.JSON(500, gin.H{"error": "保存失败"})
+			return
+		}
+		c.JSON(200, gin.H{"secret": secret, "uri": totpURI(username, secret)})
+	}
+}
+
+// 确认启用两步验证，返回一次性展示的恢复码
+func ginHandleTOTPEnable(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		username := currentSession(c).Username
+		var secret sql.NullString
+		var enabled bool
+		if err := db.QueryRow("SELECT totp_secret, totp_enabled FROM admin WHERE username = ?", username).Scan(&secret, &enabled); err != nil || enabled || secret.String == "" {
+			c.JSON(400, gin.H{"error": "请先生成两步验证密钥"})
+			return
+		}
+		step, ok := verifyTOTP(secret.String, strings.TrimSpace(req.Code), 0, time.Now())
+		if !ok {
+			c.JSON(400, gin.H{"error": errInvalidTOTPCode.Error()})
+			return
+		}
+		codes, err := generateRecoveryCodes(db, username)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "生成恢复码失败"})
+			return
+		}
+		if _, err := db.Exec("UPDATE admin SET totp_enabled = 1, totp_last_step = ? WHERE username = ?", step, username); err != nil {
+			c.JSON(500, gin.H{"error": "保存失败"})
+			return
+		}
+		log.Printf("管理员 %s 已启用两步验证", username)
+		c.JSON(200, gin.H{"recovery_codes": codes})
+	}
+}
+
+// 关闭两步验证，需要同时提供密码和验证码（或恢复码）
+func ginHandleTOTPDisable(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" || req.Code == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		username := currentSession(c).Username
+		if !checkAdminLogin(dbPath, username, req.Password) {
+			c.JSON(400, gin.H{"error": "密码错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		if err := verifySecondFactor(db, username, req.Code); err != nil {
+			c.JSON(400, gin.H{"error": errInvalidTOTPCode.Error()})
+			return
+		}
+		if err := disableTOTP(db, username); err != nil {
+			c.JSON(500, gin.H{"error": "保存失败"})
+			return
+		}
+		log.Printf("管理员 %s 已关闭两步验证", username)
+		c.String(200, "ok")
+	}
+}
+
+// 重新生成恢复码，旧的恢复码全部作废
+func ginHandleRegenerateRecoveryCodes(dbPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "数据库错误"})
+			return
+		}
+		defer db.Close()
+		username := currentSession(c).Username
+		if err := verifySecondFactor(db, username, req.Code); err != nil {
+			c.JSON(400, gin.H{"error": errInvalidTOTPCode.Error()})
+			return
+		}
+		codes, err := generateRecoveryCodes(db, username)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "生成恢复码失败"})
+			return
+		}
+		c.JSON(200, gin.H{"recovery_codes": codes})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA1 测试向量，totpDigits 为 6 时取 8 位验证码的后 6 位
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+const rfc6238Key = "12345678901234567890"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		want := v.code[len(v.code)-totpDigits:]
+		if got := totpCode([]byte(rfc6238Key), v.unix/totpPeriod); got != want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Key))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	key := []byte(rfc6238Key)
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", totpCode(key, current), 0, current, true},
+		{"previous step within skew", totpCode(key, current-1), 0, current - 1, true},
+		{"next step within skew", totpCode(key, current+1), 0, current + 1, true},
+		{"outside skew", totpCode(key, current-2), 0, 0, false},
+		{"replay of used step", totpCode(key, current), current, 0, false},
+		{"older than used step", totpCode(key, current-1), current, 0, false},
+		{"wrong length", "1234", 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(secret, tt.code, tt.lastStep, now)
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: verifyTOTP = (%d, %v), want (%d, %v)", tt.name, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+	// 身份验证器应用里的密钥可能是小写
+	if _, ok := verifyTOTP(lowerASCII(secret), totpCode(key, current), 0, now); !ok {
+		t.Error("verifyTOTP rejected lowercase secret")
+	}
+}
+
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// openTestDB 在临时目录中创建并初始化数据库，包含默认管理员 admin
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	initDB(dbPath)
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func enableTestTOTP(t *testing.T, db *sql.DB, username string) []byte {
+	t.Helper()
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %v", err)
+	}
+	if _, err := db.Exec("UPDATE admin SET totp_secret = ?, totp_enabled = 1, totp_last_step = 0 WHERE username = ?", secret, username); err != nil {
+		t.Fatalf("启用两步验证失败: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("解码密钥失败: %v", err)
+	}
+	return key
+}
+
+func TestVerifySecondFactorRejectsReplay(t *testing.T) {
+	db := openTestDB(t)
+	key := enableTestTOTP(t, db, "admin")
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	if err := verifySecondFactor(db, "admin", code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	var lastStep int64
+	if err := db.QueryRow("SELECT totp_last_step FROM admin WHERE username = ?", "admin").Scan(&lastStep); err != nil {
+		t.Fatal(err)
+	}
+	if lastStep == 0 {
+		t.Fatal("totp_last_step not updated after successful verification")
+	}
+	if err := verifySecondFactor(db, "admin", code); err != errInvalidTOTPCode {
+		t.Fatalf("replay: got %v, want errInvalidTOTPCode", err)
+	}
+}
+
+func TestVerifySecondFactorRequiresEnabled(t *testing.T) {
+	db := openTestDB(t)
+	key := enableTestTOTP(t, db, "admin")
+	if _, err := db.Exec("UPDATE admin SET totp_enabled = 0 WHERE username = ?", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	if err := verifySecondFactor(db, "admin", code); err != errInvalidTOTPCode {
+		t.Fatalf("got %v, want errInvalidTOTPCode", err)
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	db := openTestDB(t)
+	enableTestTOTP(t, db, "admin")
+	codes, err := generateRecoveryCodes(db, "admin")
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// 输入时允许省略分隔符、使用小写
+	if err := verifySecondFactor(db, "admin", lowerASCII(normalizeRecoveryCode(codes[0]))); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := verifySecondFactor(db, "admin", codes[0]); err != errInvalidTOTPCode {
+		t.Fatalf("reuse: got %v, want errInvalidTOTPCode", err)
+	}
+	if err := verifySecondFactor(db, "admin", codes[1]); err != nil {
+		t.Fatalf("other code: %v", err)
+	}
+
+	// 重新生成后旧的恢复码全部作废
+	if _, err := generateRecoveryCodes(db, "admin"); err != nil {
+		t.Fatalf("generateRecoveryCodes: %v", err)
+	}
+	if err := verifySecondFactor(db, "admin", codes[2]); err != errInvalidTOTPCode {
+		t.Fatalf("old code after regenerate: got %v, want errInvalidTOTPCode", err)
+	}
+}
+
+func TestLoginGuardWait(t *testing.T) {
+	g := &LoginGuard{lockout: 15 * time.Minute}
+	last := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name        string
+		count       int
+		maxFailures int
+		now         time.Time
+		wantDelay   time.Duration
+		wantLocked  bool
+	}{
+		{"no failures", 0, 5, last, 0, false},
+		{"first failure", 1, 5, last, time.Second, false},
+		{"second failure", 2, 5, last, 2 * time.Second, false},
+		{"fourth failure", 4, 5, last, 8 * time.Second, false},
+		{"delay partly elapsed", 2, 5, last.Add(500 * time.Millisecond), 1500 * time.Millisecond, false},
+		{"delay elapsed", 1, 5, last.Add(2 * time.Second), -time.Second, false},
+		{"capped delay", 6, 0, last, loginMaxDelay, false},
+		{"capped delay for large count", 100, 0, last, loginMaxDelay, false},
+		{"locked at limit", 5, 5, last, 15 * time.Minute, true},
+		{"locked above limit", 7, 5, last.Add(time.Minute), 14 * time.Minute, true},
+		{"lock expired", 5, 5, last.Add(16 * time.Minute), -time.Minute, true},
+		{"zero limit never locks", 1000, 0, last, loginMaxDelay, false},
+	}
+	for _, tt := range tests {
+		delay, locked := g.wait(tt.count, tt.maxFailures, last, tt.now)
+		if delay != tt.wantDelay || locked != tt.wantLocked {
+			t.Errorf("%s: wait = (%v, %v), want (%v, %v)", tt.name, delay, locked, tt.wantDelay, tt.wantLocked)
+		}
+	}
+}